@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stash86/kucoin-proxy/export"
+	"github.com/stash86/kucoin-proxy/model"
+	"github.com/stash86/kucoin-proxy/proxy"
+	"github.com/stash86/kucoin-proxy/proxy/kucoin"
+	"github.com/stash86/kucoin-proxy/store"
+	"github.com/valyala/fasthttp"
+)
+
+const backfillCommand = "backfill"
+
+type backfill struct {
+	Verbose       int           `help:"verbose level: 0 - info, 1 - debug, 2 - trace"`
+	Pair          string        `help:"pair to backfill, e.g. BTC-USDT"`
+	Tf            string        `help:"kucoin timeframe, e.g. 1hour"`
+	From          string        `help:"start of the range: RFC3339, YYYY-MM-DD or unix seconds"`
+	To            string        `help:"end of the range: RFC3339, YYYY-MM-DD or unix seconds (default now)"`
+	Output        string        `help:"output file (default {pair}-{tf}.{format})"`
+	Format        string        `help:"output format: csv, jsonl, json (freqtrade) or feather (freqtrade)"`
+	ClientTimeout time.Duration `help:"client timeout"`
+
+	KucoinConfig kucoin.Config `flag:"!embed"`
+}
+
+func newBackfill() *backfill {
+	return &backfill{
+		Verbose:       0,
+		Format:        "csv",
+		ClientTimeout: time.Second * 15,
+		KucoinConfig:  newApp().KucoinConfig,
+	}
+}
+
+func parseTime(value string) (time.Time, error) {
+	if ts, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(ts, 0).UTC(), nil
+	}
+
+	if ts, err := time.Parse(time.RFC3339, value); err == nil {
+		return ts.UTC(), nil
+	}
+
+	return time.Parse(time.DateOnly, value)
+}
+
+func (b *backfill) Run() error {
+	logrus.SetOutput(os.Stdout)
+
+	if b.Verbose < 0 || b.Verbose > 2 {
+		return fmt.Errorf("wrong verbose level '%d'", b.Verbose)
+	}
+
+	(&app{Verbose: b.Verbose}).configure()
+
+	if b.Pair == "" || b.Tf == "" || b.From == "" {
+		return fmt.Errorf("pair, tf and from are required")
+	}
+
+	// the format is only used once everything is downloaded, a typo must not cost the whole run
+	if !slices.Contains(export.Formats(), b.Format) {
+		return fmt.Errorf("unknown format '%s', supported: %v", b.Format, export.Formats())
+	}
+
+	if err := b.KucoinConfig.Validate(); err != nil {
+		return err
+	}
+
+	from, err := parseTime(b.From)
+	if err != nil {
+		return fmt.Errorf("wrong from '%s': %w", b.From, err)
+	}
+
+	to := time.Now().UTC()
+	if b.To != "" {
+		if to, err = parseTime(b.To); err != nil {
+			return fmt.Errorf("wrong to '%s': %w", b.To, err)
+		}
+	}
+
+	if b.Output == "" {
+		b.Output = fmt.Sprintf("%s-%s.%s", b.Pair, b.Tf, b.Format)
+	}
+
+	// candles are spooled as json lines next to the output, so an interrupted run resumes where it stopped
+	spoolPath := b.Output + ".part"
+
+	spooled, err := readSpool(spoolPath)
+	if err != nil {
+		return err
+	}
+
+	if len(spooled) > 0 {
+		last := spooled[len(spooled)-1].Ts
+		logrus.Infof("resuming backfill from '%s' after %d spooled candles", last.Format(time.RFC3339), len(spooled))
+		if last.After(from) {
+			from = last.Add(time.Second)
+		}
+	}
+
+	spool, err := os.OpenFile(spoolPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	defer spool.Close()
+
+	client := &proxy.Client{
+		Client: fasthttp.Client{
+			ReadTimeout:  b.ClientTimeout,
+			WriteTimeout: b.ClientTimeout,
+		},
+	}
+
+	exchange := kucoin.New(store.NewStore(0, store.GapSkip), nil, store.NewTTLCache(0), client, &b.KucoinConfig)
+
+	err = exchange.Backfill(context.Background(), b.Pair, b.Tf, from, to, func(_ store.Span, candles []*model.Candle) error {
+		if err := export.WriteJSONLines(spool, candles); err != nil {
+			return err
+		}
+
+		return spool.Sync()
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := spool.Close(); err != nil {
+		return err
+	}
+
+	candles, err := readSpool(spoolPath)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := b.Output + ".tmp"
+	out, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if err := export.Write(out, b.Format, candles); err != nil {
+		return err
+	}
+
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpPath, b.Output); err != nil {
+		return err
+	}
+
+	logrus.Infof("backfill of %d candles written to '%s'", len(candles), b.Output)
+
+	return os.Remove(spoolPath)
+}
+
+// readSpool returns spooled candles sorted in ascending order with duplicates removed.
+func readSpool(path string) ([]*model.Candle, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	candles, err := export.ReadJSONLines(f)
+	if err != nil {
+		return nil, fmt.Errorf("read spool '%s': %w", path, err)
+	}
+
+	sort.SliceStable(candles, func(i, j int) bool { return candles[i].Ts.Before(candles[j].Ts) })
+
+	deduped := candles[:0]
+	for _, c := range candles {
+		if len(deduped) > 0 && deduped[len(deduped)-1].Ts.Equal(c.Ts) {
+			deduped[len(deduped)-1] = c
+			continue
+		}
+		deduped = append(deduped, c)
+	}
+
+	return deduped, nil
+}
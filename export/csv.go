@@ -0,0 +1,41 @@
+package export
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+
+	"github.com/stash86/kucoin-proxy/model"
+)
+
+var csvHeader = []string{"ts", "open", "high", "low", "close", "volume", "amount"}
+
+func floatFmt(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func writeCSV(w io.Writer, candles []*model.Candle) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+
+	for _, c := range candles {
+		record := []string{
+			strconv.FormatInt(c.Ts.Unix(), 10),
+			floatFmt(c.Open),
+			floatFmt(c.High),
+			floatFmt(c.Low),
+			floatFmt(c.Close),
+			floatFmt(c.Volume),
+			floatFmt(c.Amount),
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+
+	return cw.Error()
+}
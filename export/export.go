@@ -0,0 +1,40 @@
+// Package export encodes candles into files consumable by backtesting tools.
+package export
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/stash86/kucoin-proxy/model"
+)
+
+type writeFn func(w io.Writer, candles []*model.Candle) error
+
+var formats = map[string]writeFn{
+	"csv":     writeCSV,
+	"jsonl":   WriteJSONLines,
+	"json":    writeFreqtradeJSON,
+	"feather": writeFreqtradeFeather,
+}
+
+// Formats returns the names of the supported formats.
+func Formats() []string {
+	names := make([]string, 0, len(formats))
+	for name := range formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Write encodes candles, expected in ascending order, in the given format.
+func Write(w io.Writer, format string, candles []*model.Candle) error {
+	fn, ok := formats[format]
+	if !ok {
+		return fmt.Errorf("unknown format '%s', supported: %v", format, Formats())
+	}
+
+	return fn(w, candles)
+}
@@ -0,0 +1,64 @@
+package export_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/apache/arrow-go/v18/arrow/ipc"
+	"github.com/stash86/kucoin-proxy/export"
+	"github.com/stash86/kucoin-proxy/model"
+)
+
+func testCandles() []*model.Candle {
+	ts := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	return []*model.Candle{
+		{Ts: ts, Open: 1, High: 3, Low: 0.5, Close: 2, Volume: 10, Amount: 20},
+		{Ts: ts.Add(time.Hour), Open: 2, High: 4, Low: 1.5, Close: 3, Volume: 11, Amount: 21},
+	}
+}
+
+func TestJSONLinesRoundTripIgnoresTruncatedTail(t *testing.T) {
+	buff := bytes.NewBuffer(nil)
+	if err := export.WriteJSONLines(buff, testCandles()); err != nil {
+		t.Fatal(err)
+	}
+	buff.WriteString(`{"ts":17040`)
+
+	candles, err := export.ReadJSONLines(buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(candles) != 2 || *candles[1] != *testCandles()[1] {
+		t.Errorf("ReadJSONLines() = %+v", candles)
+	}
+}
+
+func TestFeatherIsArrowFile(t *testing.T) {
+	buff := bytes.NewBuffer(nil)
+	if err := export.Write(buff, "feather", testCandles()); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := ipc.NewFileReader(bytes.NewReader(buff.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	record, err := reader.Record(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if record.NumRows() != 2 || record.NumCols() != 6 || record.ColumnName(0) != "date" {
+		t.Errorf("feather record = %v", record)
+	}
+}
+
+func TestUnknownFormat(t *testing.T) {
+	if err := export.Write(bytes.NewBuffer(nil), "xlsx", testCandles()); err == nil {
+		t.Error("Write() should fail for unknown format")
+	}
+}
@@ -0,0 +1,60 @@
+package export
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/ipc"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+	"github.com/stash86/kucoin-proxy/model"
+)
+
+// writeFreqtradeJSON writes freqtrade's json data format: [[ts_ms, open, high, low, close, volume], ...].
+func writeFreqtradeJSON(w io.Writer, candles []*model.Candle) error {
+	rows := make([][6]float64, 0, len(candles))
+	for _, c := range candles {
+		rows = append(rows, [6]float64{float64(c.Ts.UnixMilli()), c.Open, c.High, c.Low, c.Close, c.Volume})
+	}
+
+	return json.NewEncoder(w).Encode(rows)
+}
+
+var freqtradeSchema = arrow.NewSchema([]arrow.Field{
+	{Name: "date", Type: &arrow.TimestampType{Unit: arrow.Millisecond, TimeZone: "UTC"}},
+	{Name: "open", Type: arrow.PrimitiveTypes.Float64},
+	{Name: "high", Type: arrow.PrimitiveTypes.Float64},
+	{Name: "low", Type: arrow.PrimitiveTypes.Float64},
+	{Name: "close", Type: arrow.PrimitiveTypes.Float64},
+	{Name: "volume", Type: arrow.PrimitiveTypes.Float64},
+}, nil)
+
+// writeFreqtradeFeather writes freqtrade's feather data format, an arrow ipc file with a utc date column.
+func writeFreqtradeFeather(w io.Writer, candles []*model.Candle) error {
+	builder := array.NewRecordBuilder(memory.DefaultAllocator, freqtradeSchema)
+	defer builder.Release()
+
+	for _, c := range candles {
+		builder.Field(0).(*array.TimestampBuilder).Append(arrow.Timestamp(c.Ts.UnixMilli()))
+		builder.Field(1).(*array.Float64Builder).Append(c.Open)
+		builder.Field(2).(*array.Float64Builder).Append(c.High)
+		builder.Field(3).(*array.Float64Builder).Append(c.Low)
+		builder.Field(4).(*array.Float64Builder).Append(c.Close)
+		builder.Field(5).(*array.Float64Builder).Append(c.Volume)
+	}
+
+	record := builder.NewRecordBatch()
+	defer record.Release()
+
+	fw, err := ipc.NewFileWriter(w, ipc.WithSchema(freqtradeSchema))
+	if err != nil {
+		return err
+	}
+
+	if err := fw.Write(record); err != nil {
+		return err
+	}
+
+	return fw.Close()
+}
@@ -0,0 +1,75 @@
+package export
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/stash86/kucoin-proxy/model"
+)
+
+type jsonLine struct {
+	Ts     int64   `json:"ts"`
+	Open   float64 `json:"open"`
+	High   float64 `json:"high"`
+	Low    float64 `json:"low"`
+	Close  float64 `json:"close"`
+	Volume float64 `json:"volume"`
+	Amount float64 `json:"amount"`
+}
+
+// WriteJSONLines encodes every candle as a JSON object on its own line.
+func WriteJSONLines(w io.Writer, candles []*model.Candle) error {
+	enc := json.NewEncoder(w)
+	for _, c := range candles {
+		line := jsonLine{
+			Ts:     c.Ts.Unix(),
+			Open:   c.Open,
+			High:   c.High,
+			Low:    c.Low,
+			Close:  c.Close,
+			Volume: c.Volume,
+			Amount: c.Amount,
+		}
+		if err := enc.Encode(line); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ReadJSONLines decodes candles written by WriteJSONLines. A truncated last line, left by an
+// interrupted write, is ignored.
+func ReadJSONLines(r io.Reader) ([]*model.Candle, error) {
+	candles := make([]*model.Candle, 0, 1024)
+
+	var malformed error
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if malformed != nil {
+			return nil, malformed
+		}
+
+		line := jsonLine{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			malformed = fmt.Errorf("parse candle line '%s': %w", scanner.Text(), err)
+			continue
+		}
+
+		candles = append(candles, &model.Candle{
+			Ts:     time.Unix(line.Ts, 0).UTC(),
+			Open:   line.Open,
+			High:   line.High,
+			Low:    line.Low,
+			Close:  line.Close,
+			Volume: line.Volume,
+			Amount: line.Amount,
+		})
+	}
+
+	return candles, scanner.Err()
+}
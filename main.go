@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	_ "embed"
+	"flag"
 	"fmt"
 	"os"
 	"os/signal"
@@ -15,6 +16,7 @@ import (
 	"github.com/stash86/kucoin-proxy/proxy"
 	"github.com/stash86/kucoin-proxy/proxy/kucoin"
 	"github.com/stash86/kucoin-proxy/store"
+	"github.com/stash86/kucoin-proxy/tracing"
 	"github.com/valyala/fasthttp"
 )
 
@@ -27,9 +29,22 @@ var (
 
 type app struct {
 	Verbose         int           `help:"verbose level: 0 - info, 1 - debug, 2 - trace"`
+	LogFormat       string        `help:"log format: text or json"`
 	CacheSize       int           `help:"amount of candles to cache"`
+	MaxCandles      int           `help:"global budget of cached candles across all pairs and timeframes, the least recently requested ones are evicted beyond it. 0 - unlimited"`
+	GapMode         string        `help:"filling of skipped periods in cached candles: paint - copy the previous candle without volume, skip - leave the gap, backfill - paint and refetch the gap from the exchange"`
 	TTLCacheTimeout time.Duration `help:"ttl of blobs of cached data"`
+	TTLCacheEntries int           `help:"max amount of blobs of cached data, the least recently used ones are evicted beyond it. 0 - unlimited"`
+	TTLCacheBytes   int           `help:"max total size of blobs of cached data and their compressed variants in bytes, the least recently used ones are evicted beyond it. 0 - unlimited"`
+	TTLCacheSweep   time.Duration `help:"interval of sweeping expired blobs of cached data"`
+	ArchiveDir      string        `help:"directory of the on-disk archive of closed candles, disabled if empty"`
 	ClientTimeout   time.Duration `help:"client timeout"`
+	Record          string        `help:"record upstream http exchanges and ws frames to the file"`
+	Replay          string        `help:"serve upstream from the recording file instead of the exchange"`
+	ReplaySpeed     float64       `help:"replay time compression factor, 0 - replay ws frames without pauses"`
+	ForwardHeaders  bool          `help:"add X-Forwarded-For/Host/Proto of clients to requests passed to the exchange, they are stripped otherwise"`
+	TraceEndpoint   string        `help:"OTLP/HTTP endpoint receiving traces, e.g. http://localhost:4318, tracing is disabled if empty"`
+	TraceRatio      float64       `help:"ratio of sampled traces [0-1], traces of sampled clients are always kept"`
 
 	ProxyConfig  proxy.Config  `flag:"!embed"`
 	KucoinConfig kucoin.Config `flag:"!embed"`
@@ -38,21 +53,35 @@ type app struct {
 func newApp() *app {
 	return &app{
 		Verbose:         0,
+		LogFormat:       logFormatText,
 		CacheSize:       1000,
+		GapMode:         string(store.GapPaint),
 		TTLCacheTimeout: time.Minute * 10,
+		TTLCacheEntries: 10000,
+		TTLCacheSweep:   time.Minute,
 		ClientTimeout:   time.Second * 15,
+		ReplaySpeed:     1,
+		TraceRatio:      1,
 		KucoinConfig: kucoin.Config{
-			KucoinTopicsPerWs: 200,
-			KucoinApiURL:      "https://openapi-v2.kucoin.com",
+			KucoinTopicsPerWs:   200,
+			KucoinApiURL:        "https://openapi-v2.kucoin.com",
+			KucoinFormingCandle: kucoin.FormingInclude,
 		},
 		ProxyConfig: proxy.Config{
 			Port:             "8080",
 			Bindaddr:         "0.0.0.0",
+			SocketMode:       "0660",
 			ConcurrencyLimit: fasthttp.DefaultConcurrency,
+			ApiKeyHeader:     "X-Api-Key",
 		},
 	}
 }
 
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
 func (app *app) configure() {
 	switch app.Verbose {
 	case 0:
@@ -62,6 +91,10 @@ func (app *app) configure() {
 	case 2:
 		logrus.SetLevel(logrus.TraceLevel)
 	}
+
+	if app.LogFormat == logFormatJSON {
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	}
 }
 
 func (app *app) Run() error {
@@ -76,6 +109,10 @@ func (app *app) Run() error {
 		return fmt.Errorf("wrong verbose level '%d'", app.Verbose)
 	}
 
+	if app.LogFormat != logFormatText && app.LogFormat != logFormatJSON {
+		return fmt.Errorf("wrong log format '%s'", app.LogFormat)
+	}
+
 	app.configure()
 
 	logrus.Infof("Validating proxy config: %+v", app.ProxyConfig)
@@ -90,23 +127,103 @@ func (app *app) Run() error {
 		return err
 	}
 
+	shutdownTracing := func(context.Context) error { return nil }
+	if app.TraceEndpoint != "" {
+		if app.TraceRatio < 0 || app.TraceRatio > 1 {
+			return fmt.Errorf("wrong trace ratio '%g'", app.TraceRatio)
+		}
+
+		logrus.Infof("Exporting traces to '%s' with ratio %g", app.TraceEndpoint, app.TraceRatio)
+		var err error
+		if shutdownTracing, err = tracing.Setup(app.TraceEndpoint, app.TraceRatio, version); err != nil {
+			return err
+		}
+	}
+
 	logrus.Infof("Initializing HTTP client with timeout: %s", app.ClientTimeout)
 	client := &proxy.Client{
 		Client: fasthttp.Client{
 			ReadTimeout:  app.ClientTimeout,
 			WriteTimeout: app.ClientTimeout,
 		},
+		ForwardedHeaders: app.ForwardHeaders,
+	}
+
+	if app.Record != "" && app.Replay != "" {
+		return fmt.Errorf("record and replay modes are mutually exclusive")
+	}
+
+	if app.Record != "" {
+		logrus.Infof("Recording upstream traffic to '%s'", app.Record)
+		recorder, err := proxy.NewRecorder(app.Record)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := recorder.Close(); err != nil {
+				logrus.Errorf("Closing recording error: %v", err)
+			}
+		}()
+		client.Recorder = recorder
+	}
+
+	if app.Replay != "" {
+		logrus.Infof("Replaying upstream traffic from '%s' with speed %g", app.Replay, app.ReplaySpeed)
+		replayer, err := proxy.NewReplayer(app.Replay, app.ReplaySpeed)
+		if err != nil {
+			return err
+		}
+		client.Replayer = replayer
+	}
+
+	gapMode, err := store.ParseGapMode(app.GapMode)
+	if err != nil {
+		return err
+	}
+
+	var archive *store.Archive
+	if app.ArchiveDir != "" {
+		logrus.Infof("Opening candles archive in '%s'", app.ArchiveDir)
+		if archive, err = store.NewArchive(app.ArchiveDir); err != nil {
+			return err
+		}
+		defer archive.Close()
 	}
 
 	logrus.Infof("Initializing proxy server with cache size: %d, TTL cache timeout: %s", app.CacheSize, app.TTLCacheTimeout)
-	proxySrv := proxy.New(&app.ProxyConfig,
-		kucoin.New(
-			store.NewStore(app.CacheSize),
-			store.NewTTLCache(app.TTLCacheTimeout),
-			client,
-			&app.KucoinConfig,
-		),
+	candlesStore := store.NewStore(app.CacheSize, gapMode)
+	candlesStore.LimitCandles(app.MaxCandles)
+
+	if app.TTLCacheSweep <= 0 {
+		return fmt.Errorf("wrong ttl cache sweep interval '%s'", app.TTLCacheSweep)
+	}
+
+	ttlCache := store.NewTTLCache(app.TTLCacheTimeout)
+	ttlCache.Limit(app.TTLCacheEntries, app.TTLCacheBytes)
+	ttlCache.RunJanitor(app.TTLCacheSweep)
+
+	exchange := kucoin.New(
+		candlesStore,
+		archive,
+		ttlCache,
+		client,
+		&app.KucoinConfig,
 	)
+	proxySrv := proxy.New(&app.ProxyConfig, exchange)
+	proxySrv.OnShutdown(ttlCache.Close)
+	proxySrv.OnShutdown(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := shutdownTracing(ctx); err != nil {
+			logrus.Errorf("Flushing traces error: %v", err)
+		}
+	})
+
+	if err := exchange.WarmUp(); err != nil {
+		logrus.Errorf("Warm-up failed: %v", err)
+		return err
+	}
 
 	// Set up signal handling for graceful shutdown
 	shutdownCh := make(chan os.Signal, 1)
@@ -114,7 +231,10 @@ func (app *app) Run() error {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	shutdownDone := make(chan struct{})
 	go func() {
+		defer close(shutdownDone)
+
 		sig := <-shutdownCh
 		logrus.Warnf("Received shutdown signal: %s", sig)
 		err := proxySrv.GracefulShutdown(ctx, fmt.Sprintf("received signal: %s", sig))
@@ -123,21 +243,32 @@ func (app *app) Run() error {
 		} else {
 			logrus.Info("Graceful shutdown completed successfully")
 		}
-		os.Exit(0)
 	}()
 
 	logrus.Info("Proxy server starting...")
-	err := proxySrv.Serve()
+	err = proxySrv.Serve()
 	if err != nil {
 		logrus.Errorf("Proxy server error: %v", err)
 		return fmt.Errorf("proxy server error: %w", err)
 	}
+
+	// the server stops before its shutdown hooks ran, e.g. flushing traces
+	<-shutdownDone
 	logrus.Info("Proxy server stopped.")
 
 	return nil
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == backfillCommand {
+		flags := flag.NewFlagSet(backfillCommand, flag.ExitOnError)
+		if err := commandeer.RunArgs(flags, newBackfill(), os.Args[2:]); err != nil {
+			logrus.Fatal(err)
+		}
+
+		return
+	}
+
 	app := newApp()
 
 	if err := commandeer.Run(app); err != nil {
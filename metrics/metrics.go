@@ -0,0 +1,83 @@
+// Package metrics holds the prometheus metrics of the proxy.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttpadaptor"
+)
+
+const namespace = "kucoin_proxy"
+
+var (
+	// CachedCandles is the amount of candles held across all buckets.
+	CachedCandles = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cached_candles",
+		Help:      "Candles held in memory across all buckets.",
+	})
+
+	// CachedBuckets is the amount of candle buckets held in memory.
+	CachedBuckets = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cached_buckets",
+		Help:      "Candle buckets held in memory.",
+	})
+
+	// EvictedBuckets counts buckets evicted to keep the global candles budget.
+	EvictedBuckets = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "evicted_buckets_total",
+		Help:      "Candle buckets evicted to keep the global candles budget.",
+	})
+
+	// EvictedCandles counts candles dropped with evicted buckets.
+	EvictedCandles = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "evicted_candles_total",
+		Help:      "Candles dropped with evicted buckets.",
+	})
+)
+
+var (
+	// Requests counts requests per authenticated client.
+	Requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "requests_total",
+		Help:      "Requests per authenticated client.",
+	}, []string{"client"})
+
+	// RateLimited counts requests rejected per client and exhausted budget.
+	RateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limited_total",
+		Help:      "Requests rejected per client and exhausted budget, cache or upstream.",
+	}, []string{"client", "budget"})
+)
+
+var registry = prometheus.NewRegistry()
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		CachedCandles,
+		CachedBuckets,
+		EvictedBuckets,
+		EvictedCandles,
+		Requests,
+		RateLimited,
+	)
+}
+
+// Register adds collectors to the registry served by Handler.
+func Register(collectors ...prometheus.Collector) {
+	registry.MustRegister(collectors...)
+}
+
+// Handler serves the registered metrics in the prometheus text format.
+func Handler() fasthttp.RequestHandler {
+	return fasthttpadaptor.NewFastHTTPHandler(promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+}
@@ -12,16 +12,19 @@ type Candle struct {
 	Close  float64
 	Volume float64
 	Amount float64
+	// Synthetic marks a candle painted by the proxy to fill a skipped period.
+	Synthetic bool
 }
 
 func (c *Candle) Clone() *Candle {
 	return &Candle{
-		Ts:     c.Ts,
-		Open:   c.Open,
-		High:   c.High,
-		Low:    c.Low,
-		Close:  c.Close,
-		Volume: c.Volume,
-		Amount: c.Amount,
+		Ts:        c.Ts,
+		Open:      c.Open,
+		High:      c.High,
+		Low:       c.Low,
+		Close:     c.Close,
+		Volume:    c.Volume,
+		Amount:    c.Amount,
+		Synthetic: c.Synthetic,
 	}
 }
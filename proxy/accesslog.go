@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/stash86/kucoin-proxy/tracing"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	traceUserValue = "trace"
+
+	requestIDHeader   = "X-Request-Id"
+	maxRequestIDBytes = 64
+)
+
+// CacheOutcome tells how a request was served from the caches.
+type CacheOutcome string
+
+const (
+	CacheHit CacheOutcome = "hit"
+	// CacheMiss is a request served by the exchange.
+	CacheMiss CacheOutcome = "miss"
+	// CachePartial is a request served from a cache not covering all of it, or completed by the exchange.
+	CachePartial CacheOutcome = "partial"
+	// CacheStale is a request served from a cache that lacks recent updates.
+	CacheStale CacheOutcome = "stale"
+)
+
+// requestTrace collects what the handlers did for the access log line of a request.
+type requestTrace struct {
+	id       string
+	cache    atomic.Value // of CacheOutcome
+	upstream atomic.Int32
+}
+
+func traceOf(ctx context.Context) *requestTrace {
+	if ctx == nil {
+		return nil
+	}
+
+	trace, _ := ctx.Value(traceUserValue).(*requestTrace)
+
+	return trace
+}
+
+// AccessLogHandler logs a line per request with its client, status, size, latency, cache outcome and upstream
+// calls. Every request gets an id, taken from its X-Request-Id header if it is a token of at most 64 letters,
+// digits, '.', '_' or '-', which is echoed back and attached to the log lines of its upstream calls.
+func AccessLogHandler(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		id := string(ctx.Request.Header.Peek(requestIDHeader))
+		if !validRequestID(id) {
+			id = uuid.NewString()
+		}
+
+		trace := &requestTrace{id: id}
+		ctx.SetUserValue(traceUserValue, trace)
+
+		h(ctx)
+
+		// set once the response is complete, handlers resetting it
+		ctx.Response.Header.Set(requestIDHeader, id)
+
+		fields := logrus.Fields{
+			"request_id": id,
+			"method":     string(ctx.Method()),
+			"path":       string(ctx.Path()),
+			"client":     ClientName(ctx),
+			"ip":         ctx.RemoteIP().String(),
+			"status":     ctx.Response.StatusCode(),
+			"bytes":      responseSize(&ctx.Response),
+			"latency_ms": float64(time.Since(ctx.Time()).Microseconds()) / 1000,
+			"upstream":   trace.upstream.Load(),
+		}
+		if outcome, ok := trace.cache.Load().(CacheOutcome); ok {
+			fields["cache"] = string(outcome)
+		}
+		if traceID := tracing.TraceID(ctx); traceID != "" {
+			fields["trace_id"] = traceID
+		}
+
+		logrus.WithFields(fields).Info("access")
+	}
+}
+
+// validRequestID accepts ids which can't forge log lines or response headers.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDBytes {
+		return false
+	}
+
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '_' || r == '-') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// responseSize is the size of the body sent, -1 for a body streamed without a known length.
+func responseSize(resp *fasthttp.Response) int {
+	if resp.IsBodyStream() {
+		return resp.Header.ContentLength()
+	}
+
+	return len(resp.Body())
+}
+
+// RequestID returns the id of the request, empty outside of a request.
+func RequestID(ctx context.Context) string {
+	if trace := traceOf(ctx); trace != nil {
+		return trace.id
+	}
+
+	return ""
+}
+
+// SetCacheOutcome records how the request was served for its access log line.
+func SetCacheOutcome(ctx context.Context, outcome CacheOutcome) {
+	if trace := traceOf(ctx); trace != nil {
+		trace.cache.Store(outcome)
+	}
+}
+
+// CountUpstream records an upstream call made for the request.
+func CountUpstream(ctx context.Context) {
+	if trace := traceOf(ctx); trace != nil {
+		trace.upstream.Add(1)
+	}
+}
+
+// Log returns a logger carrying the id of the request.
+func Log(ctx context.Context) *logrus.Entry {
+	if id := RequestID(ctx); id != "" {
+		return logrus.WithField("request_id", id)
+	}
+
+	return logrus.NewEntry(logrus.StandardLogger())
+}
@@ -0,0 +1,106 @@
+package proxy_test
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stash86/kucoin-proxy/proxy"
+	"github.com/valyala/fasthttp"
+)
+
+func TestAccessLogHandler(t *testing.T) {
+	logrus.SetLevel(logrus.InfoLevel)
+	logrus.SetOutput(io.Discard)
+	hook := test.NewGlobal()
+	defer func() {
+		logrus.StandardLogger().ReplaceHooks(logrus.LevelHooks{})
+		logrus.SetOutput(os.Stderr)
+		logrus.SetLevel(logrus.PanicLevel)
+	}()
+
+	var requestID string
+	handler := proxy.AccessLogHandler(func(ctx *fasthttp.RequestCtx) {
+		requestID = proxy.RequestID(ctx)
+		proxy.SetCacheOutcome(ctx, proxy.CachePartial)
+		proxy.CountUpstream(ctx)
+		proxy.CountUpstream(ctx)
+		ctx.SetBodyString("candles")
+	})
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.SetRequestURI("/kucoin/api/v1/market/candles?symbol=BTC-USDT")
+	ctx.Request.Header.Set("X-Request-Id", "req-1")
+	handler(ctx)
+
+	if requestID != "req-1" {
+		t.Errorf("RequestID() = %q, want the header value", requestID)
+	}
+	if got := string(ctx.Response.Header.Peek("X-Request-Id")); got != "req-1" {
+		t.Errorf("response X-Request-Id = %q, want req-1", got)
+	}
+
+	entry := hook.LastEntry()
+	if entry == nil || entry.Message != "access" {
+		t.Fatalf("last log entry = %v, want the access line", entry)
+	}
+
+	want := logrus.Fields{
+		"request_id": "req-1",
+		"path":       "/kucoin/api/v1/market/candles",
+		"status":     fasthttp.StatusOK,
+		"bytes":      len("candles"),
+		"cache":      "partial",
+		"upstream":   int32(2),
+	}
+	for key, value := range want {
+		if entry.Data[key] != value {
+			t.Errorf("access log %s = %v, want %v", key, entry.Data[key], value)
+		}
+	}
+
+	// a request without an id gets a generated one, and no cache outcome unless a handler set it
+	ctx = &fasthttp.RequestCtx{}
+	proxy.AccessLogHandler(func(*fasthttp.RequestCtx) {})(ctx)
+
+	if len(ctx.Response.Header.Peek("X-Request-Id")) == 0 {
+		t.Error("response has no generated X-Request-Id")
+	}
+	if _, ok := hook.LastEntry().Data["cache"]; ok {
+		t.Error("access log has a cache outcome of an uncached request")
+	}
+}
+
+func TestAccessLogHandlerRequestIDs(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+
+	for _, tc := range []struct {
+		name string
+		id   string
+		kept bool
+	}{
+		{name: "token", id: "req-1.a_B", kept: true},
+		{name: "uuid", id: "0b7f1c2e-5a4d-4e6f-8a9b-0c1d2e3f4a5b", kept: true},
+		{name: "control characters", id: "req-1\x1b[31m"},
+		{name: "forged log line", id: "req-1 level=error msg=forged"},
+		{name: "non ascii", id: "req-ü"},
+		{name: "too long", id: string(make([]byte, 65))},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := &fasthttp.RequestCtx{}
+			ctx.Request.Header.Set("X-Request-Id", tc.id)
+
+			var requestID string
+			proxy.AccessLogHandler(func(ctx *fasthttp.RequestCtx) { requestID = proxy.RequestID(ctx) })(ctx)
+
+			if kept := requestID == tc.id; kept != tc.kept {
+				t.Errorf("RequestID() = %q, want kept %v", requestID, tc.kept)
+			}
+			if got := string(ctx.Response.Header.Peek("X-Request-Id")); got != requestID || got == "" {
+				t.Errorf("response X-Request-Id = %q, want %q", got, requestID)
+			}
+		})
+	}
+}
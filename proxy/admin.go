@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+
+	routing "github.com/qiangxue/fasthttp-routing"
+	"github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+)
+
+const adminPathPrefix = "/admin"
+
+var (
+	authorizationHeaderBytes   = []byte("Authorization")
+	basicAuthPrefixBytes       = []byte("Basic ")
+	wwwAuthenticateHeaderBytes = []byte("WWW-Authenticate")
+	adminRealmBytes            = []byte(`Basic realm="kucoin-proxy admin"`)
+)
+
+// Administrable is implemented by routables exposing admin routes. The routes are mounted under
+// /admin/{name}/ and require the admin credentials.
+type Administrable interface {
+	AdminRoutes() []Route
+}
+
+// parseBasicAuth extracts the credentials of an Authorization header.
+func parseBasicAuth(header []byte) (string, string, bool) {
+	if !bytes.HasPrefix(header, basicAuthPrefixBytes) {
+		return "", "", false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(string(header[len(basicAuthPrefixBytes):]))
+	if err != nil {
+		return "", "", false
+	}
+
+	user, password, ok := bytes.Cut(decoded, []byte(":"))
+	if !ok {
+		return "", "", false
+	}
+
+	return string(user), string(password), true
+}
+
+func secureEqual(a string, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// isAdmin tells whether the request has the admin basic auth credentials.
+func isAdmin(ctx *fasthttp.RequestCtx, config *Config) bool {
+	user, password, ok := parseBasicAuth(ctx.Request.Header.PeekBytes(authorizationHeaderBytes))
+
+	return ok && secureEqual(user, config.AdminUser) && secureEqual(password, config.AdminPassword)
+}
+
+// AdminAuthHandler rejects requests without the admin basic auth credentials.
+func AdminAuthHandler(config *Config) func(c *routing.Context) error {
+	return func(c *routing.Context) error {
+		if !isAdmin(c.RequestCtx, config) {
+			logrus.Warnf("admin: unauthorized request '%s' from %s", c.Request.RequestURI(), c.RemoteIP())
+			c.Response.Header.SetBytesKV(wwwAuthenticateHeaderBytes, adminRealmBytes)
+			return routing.NewHTTPError(http.StatusUnauthorized)
+		}
+
+		return nil
+	}
+}
+
+// WriteJSON writes v as a JSON response.
+func WriteJSON(c *routing.Context, statusCode int, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	c.Response.SetStatusCode(statusCode)
+	c.Response.Header.SetContentTypeBytes(contentTypeBytes)
+	c.Response.SetBody(data)
+
+	return nil
+}
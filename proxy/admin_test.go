@@ -0,0 +1,48 @@
+package proxy_test
+
+import (
+	"encoding/base64"
+	"net/http"
+	"testing"
+
+	routing "github.com/qiangxue/fasthttp-routing"
+	"github.com/sirupsen/logrus"
+	"github.com/stash86/kucoin-proxy/proxy"
+	"github.com/valyala/fasthttp"
+)
+
+func TestAdminAuthHandler(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+
+	cfg := &proxy.Config{AdminUser: "admin", AdminPassword: "secret"}
+
+	router := routing.New()
+	router.Get("/admin/test", proxy.AdminAuthHandler(cfg), func(c *routing.Context) error {
+		return proxy.WriteJSON(c, http.StatusOK, map[string]bool{"ok": true})
+	})
+
+	for _, tc := range []struct {
+		name          string
+		authorization string
+		want          int
+	}{
+		{name: "missing", authorization: "", want: http.StatusUnauthorized},
+		{name: "wrong password", authorization: "Basic " + base64.StdEncoding.EncodeToString([]byte("admin:wrong")), want: http.StatusUnauthorized},
+		{name: "malformed", authorization: "Basic !!!", want: http.StatusUnauthorized},
+		{name: "valid", authorization: "Basic " + base64.StdEncoding.EncodeToString([]byte("admin:secret")), want: http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := &fasthttp.RequestCtx{}
+			ctx.Request.SetRequestURI("/admin/test")
+			if tc.authorization != "" {
+				ctx.Request.Header.Set("Authorization", tc.authorization)
+			}
+
+			router.HandleRequest(ctx)
+
+			if got := ctx.Response.StatusCode(); got != tc.want {
+				t.Errorf("status = %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
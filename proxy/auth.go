@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stash86/kucoin-proxy/metrics"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	clientUserValue = "client"
+
+	anonymousClient    = "anonymous"
+	unauthorizedClient = "unauthorized"
+
+	unauthorizedCode = "401000"
+)
+
+// clientCredentials of a named client, either an api key or a basic auth user and password.
+type clientCredentials struct {
+	name     string
+	apiKey   string
+	user     string
+	password string
+}
+
+// parseClients parses name:api-key and name:user:password entries.
+func parseClients(entries []string) ([]clientCredentials, error) {
+	clients := make([]clientCredentials, 0, len(entries))
+
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, ":", 3)
+		for _, part := range parts {
+			if part == "" {
+				return nil, fmt.Errorf("client '%s' has an empty part", parts[0])
+			}
+		}
+
+		switch len(parts) {
+		case 2:
+			clients = append(clients, clientCredentials{name: parts[0], apiKey: parts[1]})
+		case 3:
+			clients = append(clients, clientCredentials{name: parts[0], user: parts[1], password: parts[2]})
+		default:
+			return nil, fmt.Errorf("client '%s' is neither name:api-key nor name:user:password", entry)
+		}
+	}
+
+	return clients, nil
+}
+
+// authenticate returns the name of the client the request's credentials belong to.
+func authenticate(ctx *fasthttp.RequestCtx, clients []clientCredentials, apiKeyHeader string) (string, bool) {
+	apiKey := string(ctx.Request.Header.Peek(apiKeyHeader))
+	user, password, basic := parseBasicAuth(ctx.Request.Header.PeekBytes(authorizationHeaderBytes))
+
+	name, ok := "", false
+	for _, client := range clients {
+		// every client is compared to not leak which of them matched through timing
+		switch {
+		case client.apiKey != "" && apiKey != "" && secureEqual(apiKey, client.apiKey):
+			name, ok = client.name, true
+		case client.user != "" && basic && secureEqual(user, client.user) && secureEqual(password, client.password):
+			name, ok = client.name, true
+		}
+	}
+
+	return name, ok
+}
+
+// ClientAuthHandler rejects requests without the credentials of a configured client before routing and strips
+// the credentials, so they never reach the exchange. Admin requests are left to the admin credentials.
+func ClientAuthHandler(config *Config, h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	clients, err := parseClients(config.Clients)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	return func(ctx *fasthttp.RequestCtx) {
+		// a certificate verified against the client CA authenticates on its own
+		if state := ctx.TLSConnectionState(); state != nil && len(state.VerifiedChains) > 0 {
+			serveClient(ctx, config, state.VerifiedChains[0][0].Subject.CommonName, h)
+			return
+		}
+
+		if len(clients) == 0 {
+			ctx.SetUserValue(clientUserValue, anonymousClient)
+			metrics.Requests.WithLabelValues(anonymousClient).Inc()
+			h(ctx)
+			return
+		}
+
+		if config.AdminPassword != "" && isAdminPath(ctx.Path()) {
+			h(ctx)
+			return
+		}
+
+		name, ok := authenticate(ctx, clients, config.ApiKeyHeader)
+		if !ok {
+			logrus.Warnf("unauthorized request '%s' from %s", ctx.RequestURI(), ctx.RemoteIP())
+			metrics.Requests.WithLabelValues(unauthorizedClient).Inc()
+			WriteError(ctx, http.StatusUnauthorized, unauthorizedCode, "Unauthorized")
+			return
+		}
+
+		ctx.Request.Header.DelBytes(authorizationHeaderBytes)
+		serveClient(ctx, config, name, h)
+	}
+}
+
+// serveClient hands the request of an authenticated client on, without its api key.
+func serveClient(ctx *fasthttp.RequestCtx, config *Config, name string, h fasthttp.RequestHandler) {
+	ctx.Request.Header.Del(config.ApiKeyHeader)
+
+	logrus.Debugf("client '%s': %s %s", name, ctx.Method(), ctx.RequestURI())
+	ctx.SetUserValue(clientUserValue, name)
+	metrics.Requests.WithLabelValues(name).Inc()
+
+	h(ctx)
+}
+
+func isAdminPath(path []byte) bool {
+	return bytes.HasPrefix(path, []byte(adminPathPrefix+"/")) || string(path) == metricsPath
+}
+
+// ClientName returns the name of the authenticated client of the request.
+func ClientName(ctx *fasthttp.RequestCtx) string {
+	name, _ := ctx.UserValue(clientUserValue).(string)
+
+	return name
+}
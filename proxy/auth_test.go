@@ -0,0 +1,65 @@
+package proxy_test
+
+import (
+	"encoding/base64"
+	"net/http"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stash86/kucoin-proxy/proxy"
+	"github.com/valyala/fasthttp"
+)
+
+func TestClientAuthHandler(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+
+	cfg := &proxy.Config{
+		Clients:       []string{"bot1:key1", "bot2:user:secret"},
+		ApiKeyHeader:  "X-Api-Key",
+		AdminUser:     "admin",
+		AdminPassword: "admin",
+	}
+
+	var client, forwardedKey, forwardedAuth string
+	handler := proxy.ClientAuthHandler(cfg, func(ctx *fasthttp.RequestCtx) {
+		client = proxy.ClientName(ctx)
+		forwardedKey = string(ctx.Request.Header.Peek("X-Api-Key"))
+		forwardedAuth = string(ctx.Request.Header.Peek("Authorization"))
+	})
+
+	for _, tc := range []struct {
+		name    string
+		path    string
+		headers map[string]string
+		want    int
+		client  string
+	}{
+		{name: "missing", path: "/kucoin/api/v1/symbols", want: http.StatusUnauthorized},
+		{name: "wrong key", path: "/kucoin/api/v1/symbols", headers: map[string]string{"X-Api-Key": "key2"}, want: http.StatusUnauthorized},
+		{name: "api key", path: "/kucoin/api/v1/symbols", headers: map[string]string{"X-Api-Key": "key1"}, want: http.StatusOK, client: "bot1"},
+		{name: "basic auth", path: "/kucoin/api/v1/symbols", headers: map[string]string{"Authorization": "Basic " + base64.StdEncoding.EncodeToString([]byte("user:secret"))}, want: http.StatusOK, client: "bot2"},
+		{name: "admin", path: "/admin/kucoin/buckets", want: http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client, forwardedKey, forwardedAuth = "", "", ""
+
+			ctx := &fasthttp.RequestCtx{}
+			ctx.Request.SetRequestURI(tc.path)
+			for k, v := range tc.headers {
+				ctx.Request.Header.Set(k, v)
+			}
+
+			handler(ctx)
+
+			if got := ctx.Response.StatusCode(); got != tc.want {
+				t.Errorf("status = %d, want %d", got, tc.want)
+			}
+			if client != tc.client {
+				t.Errorf("client = %q, want %q", client, tc.client)
+			}
+			if tc.client != "" && (forwardedKey != "" || forwardedAuth != "") {
+				t.Errorf("credentials were forwarded: %q %q", forwardedKey, forwardedAuth)
+			}
+		})
+	}
+}
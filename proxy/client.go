@@ -1,11 +1,15 @@
 package proxy
 
 import (
+	"context"
 	"fmt"
 	"time"
 
+	"github.com/dgrr/websocket"
 	"github.com/sirupsen/logrus"
+	"github.com/stash86/kucoin-proxy/tracing"
 	"github.com/valyala/fasthttp"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
 )
 
 var (
@@ -14,11 +18,34 @@ var (
 
 type Client struct {
 	fasthttp.Client
+
+	// Recorder, when set, receives every upstream HTTP exchange and websocket frame.
+	Recorder *Recorder
+	// Replayer, when set, serves a recording instead of talking to the upstream.
+	Replayer *Replayer
+	// ForwardedHeaders adds X-Forwarded-* headers of proxied clients to upstream requests instead of stripping them.
+	ForwardedHeaders bool
+}
+
+func (c *Client) do(req *fasthttp.Request, resp *fasthttp.Response) error {
+	if c.Replayer != nil {
+		return c.Replayer.do(req, resp)
+	}
+
+	if err := c.Client.Do(req, resp); err != nil {
+		return err
+	}
+
+	if c.Recorder != nil {
+		c.Recorder.recordHTTP(req, resp)
+	}
+
+	return nil
 }
 
 func (c *Client) Do(req *fasthttp.Request, resp *fasthttp.Response) error {
 	for {
-		if err := c.Client.Do(req, resp); err != nil {
+		if err := c.do(req, resp); err != nil {
 			return err
 		}
 
@@ -57,3 +84,84 @@ func (c *Client) Do(req *fasthttp.Request, resp *fasthttp.Response) error {
 
 	return nil
 }
+
+// DoContext performs the request through Do in a span of ctx.
+func (c *Client) DoContext(ctx context.Context, req *fasthttp.Request, resp *fasthttp.Response) (err error) {
+	_, span := tracing.Start(ctx, "upstream "+string(req.Header.Method()),
+		semconv.HTTPRequestMethodKey.String(string(req.Header.Method())),
+		semconv.ServerAddress(string(req.URI().Host())),
+		semconv.URLPath(string(req.URI().Path())),
+	)
+	defer func() {
+		span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode()))
+		tracing.End(span, err)
+	}()
+
+	return c.Do(req, resp)
+}
+
+// Get performs a GET request through Do, so it is recorded and replayed like any other upstream call.
+func (c *Client) Get(dst []byte, url string) (int, []byte, error) {
+	return c.GetContext(context.Background(), dst, url)
+}
+
+// GetContext performs a GET request like Get in a span of ctx.
+func (c *Client) GetContext(ctx context.Context, dst []byte, url string) (int, []byte, error) {
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	req.SetRequestURI(url)
+	req.Header.SetMethod(fasthttp.MethodGet)
+
+	return c.execute(ctx, dst, req)
+}
+
+// Post performs a POST request through Do, so it is recorded and replayed like any other upstream call.
+func (c *Client) Post(dst []byte, url string, postArgs *fasthttp.Args) (int, []byte, error) {
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	req.SetRequestURI(url)
+	req.Header.SetMethod(fasthttp.MethodPost)
+	req.Header.SetContentType("application/x-www-form-urlencoded")
+	if postArgs != nil {
+		if _, err := postArgs.WriteTo(req.BodyWriter()); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	return c.execute(context.Background(), dst, req)
+}
+
+func (c *Client) execute(ctx context.Context, dst []byte, req *fasthttp.Request) (int, []byte, error) {
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+
+	if err := c.DoContext(ctx, req, resp); err != nil {
+		return 0, dst, err
+	}
+
+	return resp.StatusCode(), append(dst, resp.Body()...), nil
+}
+
+// DialWS opens a websocket connection to the upstream, recording or replaying it when configured.
+func (c *Client) DialWS(url string) (WSConn, error) {
+	if c.Replayer != nil {
+		// a nil *replayConn would make a non-nil WSConn
+		conn, err := c.Replayer.dialWS()
+		if err != nil {
+			return nil, err
+		}
+
+		return conn, nil
+	}
+
+	conn, err := websocket.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Recorder != nil {
+		return &recordingConn{Client: conn, id: c.Recorder.nextConnID(), recorder: c.Recorder}, nil
+	}
+
+	return conn, nil
+}
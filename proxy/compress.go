@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	routing "github.com/qiangxue/fasthttp-routing"
+	"github.com/stash86/kucoin-proxy/store"
+	"github.com/stash86/kucoin-proxy/tracing"
+	"github.com/valyala/fasthttp"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	brotliEncoding = "br"
+	gzipEncoding   = "gzip"
+)
+
+var varyHeaderBytes = []byte("Vary")
+
+// CompressHandler compresses responses for clients accepting brotli or gzip, unless the body is encoded already.
+func CompressHandler(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	// the response of h is compressed by a handler of its own, so the compression is traced apart
+	compress := fasthttp.CompressHandlerBrotliLevel(func(*fasthttp.RequestCtx) {}, fasthttp.CompressBrotliDefaultCompression, fasthttp.CompressDefaultCompression)
+
+	return func(ctx *fasthttp.RequestCtx) {
+		h(ctx)
+
+		if len(ctx.Response.Header.ContentEncoding()) > 0 ||
+			!ctx.Request.Header.HasAcceptEncoding(brotliEncoding) && !ctx.Request.Header.HasAcceptEncoding(gzipEncoding) {
+			return
+		}
+
+		_, span := tracing.Start(ctx, "compress")
+		compress(ctx)
+		span.SetAttributes(attribute.String("http.response.content_encoding", string(ctx.Response.Header.ContentEncoding())))
+		span.End()
+	}
+}
+
+// acceptedEncoding picks the encoding of the response, brotli being preferred over gzip.
+func acceptedEncoding(c *routing.Context) string {
+	switch {
+	case c.Request.Header.HasAcceptEncoding(brotliEncoding):
+		return brotliEncoding
+	case c.Request.Header.HasAcceptEncoding(gzipEncoding):
+		return gzipEncoding
+	}
+
+	return ""
+}
+
+func encode(encoding string, data []byte) []byte {
+	switch encoding {
+	case brotliEncoding:
+		return fasthttp.AppendBrotliBytesLevel(nil, data, fasthttp.CompressBrotliDefaultCompression)
+	case gzipEncoding:
+		return fasthttp.AppendGzipBytesLevel(nil, data, fasthttp.CompressDefaultCompression)
+	}
+
+	return data
+}
+
+// setCachedBody responds with the blob of the container in the encoding accepted by the client, its
+// encoded variants are cached along with it.
+func setCachedBody(c *routing.Context, container *store.Container) {
+	body := container.Raw()
+
+	if encoding := acceptedEncoding(c); encoding != "" {
+		body = container.Variant(encoding, func(raw []byte) []byte {
+			_, span := tracing.Start(c.RequestCtx, "compress", attribute.String("http.response.content_encoding", encoding))
+			defer span.End()
+
+			return encode(encoding, raw)
+		})
+		c.Response.Header.SetContentEncoding(encoding)
+	}
+
+	c.Response.Header.SetBytesK(varyHeaderBytes, fasthttp.HeaderAcceptEncoding)
+	c.Response.SetBodyRaw(body)
+	c.Response.Header.SetContentLength(len(body))
+}
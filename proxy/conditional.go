@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"time"
+
+	routing "github.com/qiangxue/fasthttp-routing"
+	"github.com/valyala/fasthttp"
+)
+
+// ETag is a strong validator of the content hash.
+func ETag(data []byte) string {
+	hash := fnv.New64a()
+	hash.Write(data) //nolint:errcheck
+
+	return fmt.Sprintf(`"%x"`, hash.Sum64())
+}
+
+// NotModified sets the validators of the response and answers 304 when the request's conditions match them,
+// reporting whether it did. A zero lastModified is not sent.
+func NotModified(c *routing.Context, etag string, lastModified time.Time) bool {
+	c.Response.Header.Set(fasthttp.HeaderETag, etag)
+	if !lastModified.IsZero() {
+		c.Response.Header.Set(fasthttp.HeaderLastModified, lastModified.UTC().Format(http.TimeFormat))
+	}
+
+	// If-None-Match takes precedence over If-Modified-Since
+	if ifNoneMatch := c.Request.Header.Peek(fasthttp.HeaderIfNoneMatch); len(ifNoneMatch) > 0 {
+		if !matchesETag(ifNoneMatch, etag) {
+			return false
+		}
+	} else {
+		since, err := http.ParseTime(string(c.Request.Header.Peek(fasthttp.HeaderIfModifiedSince)))
+		if err != nil || lastModified.IsZero() || lastModified.Truncate(time.Second).After(since) {
+			return false
+		}
+	}
+
+	c.Response.ResetBody()
+	c.Response.SetStatusCode(http.StatusNotModified)
+
+	return true
+}
+
+func matchesETag(ifNoneMatch []byte, etag string) bool {
+	for _, candidate := range bytes.Split(ifNoneMatch, []byte(",")) {
+		candidate = bytes.TrimPrefix(bytes.TrimSpace(candidate), []byte("W/"))
+		if string(candidate) == "*" || string(candidate) == etag {
+			return true
+		}
+	}
+
+	return false
+}
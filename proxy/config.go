@@ -1,21 +1,83 @@
 package proxy
 
 import (
+	"fmt"
+	"strings"
+
 	validation "github.com/go-ozzo/ozzo-validation/v4"
 	"github.com/go-ozzo/ozzo-validation/v4/is"
 	"github.com/valyala/fasthttp"
 )
 
 type Config struct {
-	Port             string `help:"listen port"`
-	Bindaddr         string `help:"bindable address"`
-	ConcurrencyLimit int    `help:"server concurrency limit"`
+	Port             string   `help:"listen port"`
+	Bindaddr         string   `help:"bindable address, IPv4 or IPv6"`
+	Listen           []string `help:"addresses to listen on as host:port or unix:///path/to.sock, overriding bindaddr and port"`
+	SocketMode       string   `help:"permissions of unix socket files"`
+	ConcurrencyLimit int      `help:"server concurrency limit"`
+	AdminUser        string   `help:"admin api basic auth user"`
+	AdminPassword    string   `help:"admin api basic auth password, admin api is disabled if empty"`
+	Clients          []string `help:"clients allowed to use the proxy as name:api-key or name:user:password, authentication is disabled if empty"`
+	ApiKeyHeader     string   `help:"request header of client api keys"`
+
+	ClientRate         float64  `help:"requests per second of a client, by name or ip. 0 - unlimited"`
+	ClientUpstreamRate float64  `help:"requests per second of a client reaching the exchange. 0 - unlimited"`
+	ClientLimits       []string `help:"per client rates as name:rate:upstream-rate, the name being a client name or an ip"`
+
+	TLSCert     string `help:"tls certificate file, reloaded on change. tls is disabled if empty"`
+	TLSKey      string `help:"tls key file, reloaded on change"`
+	TLSClientCA string `help:"CA file verifying client certificates, the certificate common name becomes the client name"`
+
+	DebugAddr string `help:"address of the debug listener serving pprof profiles with the admin credentials, without tls, as a loopback host:port or unix:///path/to.sock, disabled if empty"`
+}
+
+// String masks the secrets of the config for logging.
+func (c Config) String() string {
+	masked := c
+	if masked.AdminPassword != "" {
+		masked.AdminPassword = "***"
+	}
+
+	masked.Clients = make([]string, 0, len(c.Clients))
+	for _, client := range c.Clients {
+		name, _, _ := strings.Cut(client, ":")
+		masked.Clients = append(masked.Clients, name+":***")
+	}
+
+	type plain Config
+
+	return fmt.Sprintf("%+v", plain(masked))
 }
 
 func (c Config) Validate() error {
 	return validation.ValidateStruct(&c,
 		validation.Field(&c.Port, is.Port),
-		validation.Field(&c.Bindaddr, is.IPv4),
+		validation.Field(&c.Bindaddr, is.IP),
+		validation.Field(&c.Listen, validation.Each(validation.By(func(value interface{}) error {
+			return validateListenAddress(value.(string))
+		}))),
+		validation.Field(&c.SocketMode, validation.By(func(interface{}) error {
+			_, err := parseSocketMode(c.SocketMode)
+			return err
+		})),
 		validation.Field(&c.ConcurrencyLimit, validation.Min(fasthttp.DefaultConcurrency)),
+		validation.Field(&c.AdminUser, validation.When(c.AdminPassword != "", validation.Required)),
+		validation.Field(&c.AdminPassword, validation.When(c.DebugAddr != "", validation.Required.Error("is required by the debug listener"))),
+		validation.Field(&c.DebugAddr, validation.When(c.DebugAddr != "", validation.By(func(interface{}) error {
+			return validateDebugAddress(c.DebugAddr)
+		}))),
+		validation.Field(&c.Clients, validation.By(func(interface{}) error {
+			_, err := parseClients(c.Clients)
+			return err
+		})),
+		validation.Field(&c.ApiKeyHeader, validation.When(len(c.Clients) > 0, validation.Required)),
+		validation.Field(&c.TLSKey, validation.When(c.TLSCert != "", validation.Required)),
+		validation.Field(&c.TLSCert, validation.When(c.TLSKey != "" || c.TLSClientCA != "", validation.Required)),
+		validation.Field(&c.ClientRate, validation.Min(0.0)),
+		validation.Field(&c.ClientUpstreamRate, validation.Min(0.0)),
+		validation.Field(&c.ClientLimits, validation.By(func(interface{}) error {
+			_, err := parseClientLimits(c.ClientLimits)
+			return err
+		})),
 	)
 }
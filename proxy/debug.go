@@ -0,0 +1,32 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/pprofhandler"
+)
+
+var debugPathPrefixBytes = []byte("/debug/pprof/")
+
+// DebugHandler serves the pprof profiles of the proxy to the admin. Goroutines of websocket connections are
+// labeled with their connection and role, which /debug/pprof/goroutine?debug=1 lists along with their stacks.
+func DebugHandler(config *Config) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		if !isAdmin(ctx, config) {
+			logrus.Warnf("debug: unauthorized request '%s' from %s", ctx.RequestURI(), ctx.RemoteIP())
+			ctx.Response.Header.SetBytesKV(wwwAuthenticateHeaderBytes, adminRealmBytes)
+			ctx.Error(http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		if !bytes.HasPrefix(ctx.Path(), debugPathPrefixBytes) {
+			ctx.NotFound()
+			return
+		}
+
+		pprofhandler.PprofHandler(ctx)
+	}
+}
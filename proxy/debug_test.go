@@ -0,0 +1,82 @@
+package proxy_test
+
+import (
+	"context"
+	"encoding/base64"
+	"runtime/pprof"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stash86/kucoin-proxy/proxy"
+	"github.com/valyala/fasthttp"
+)
+
+func TestDebugHandler(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+
+	handler := proxy.DebugHandler(&proxy.Config{AdminUser: "admin", AdminPassword: "secret"})
+
+	// a labeled goroutine shows up with its labels in the goroutine dump
+	stop := make(chan struct{})
+	defer close(stop)
+	started := make(chan struct{})
+	go pprof.Do(context.Background(), pprof.Labels("ws", "conn-1", "role", "reader"), func(context.Context) {
+		close(started)
+		<-stop
+	})
+	<-started
+
+	for _, tc := range []struct {
+		name   string
+		auth   string
+		path   string
+		status int
+		body   string
+	}{
+		{name: "unauthorized", path: "/debug/pprof/goroutine?debug=1", status: fasthttp.StatusUnauthorized},
+		{name: "wrong password", auth: "admin:wrong", path: "/debug/pprof/goroutine?debug=1", status: fasthttp.StatusUnauthorized},
+		{name: "outside of pprof", auth: "admin:secret", path: "/kucoin/api/v1/symbols", status: fasthttp.StatusNotFound},
+		{name: "goroutines", auth: "admin:secret", path: "/debug/pprof/goroutine?debug=1", status: fasthttp.StatusOK, body: `"role":"reader"`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := &fasthttp.RequestCtx{}
+			ctx.Request.SetRequestURI(tc.path)
+			if tc.auth != "" {
+				ctx.Request.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(tc.auth)))
+			}
+
+			handler(ctx)
+
+			if got := ctx.Response.StatusCode(); got != tc.status {
+				t.Errorf("status = %d, want %d", got, tc.status)
+			}
+			if !strings.Contains(string(ctx.Response.Body()), tc.body) {
+				t.Errorf("body lacks %s", tc.body)
+			}
+		})
+	}
+}
+
+func TestDebugAddrValidation(t *testing.T) {
+	for _, tc := range []struct {
+		addr  string
+		valid bool
+	}{
+		{addr: "127.0.0.1:6060", valid: true},
+		{addr: "[::1]:6060", valid: true},
+		{addr: "unix:///run/kucoin-proxy/debug.sock", valid: true},
+		{addr: "0.0.0.0:6060"},
+		{addr: ":6060"},
+		{addr: "[::]:6060"},
+		{addr: "192.168.1.10:6060"},
+		{addr: "localhost:6060"},
+	} {
+		t.Run(tc.addr, func(t *testing.T) {
+			cfg := &proxy.Config{ConcurrencyLimit: fasthttp.DefaultConcurrency, AdminUser: "admin", AdminPassword: "secret", DebugAddr: tc.addr}
+			if err := cfg.Validate(); (err == nil) != tc.valid {
+				t.Errorf("Validate() = %v, want valid %v", err, tc.valid)
+			}
+		})
+	}
+}
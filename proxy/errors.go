@@ -0,0 +1,23 @@
+package proxy
+
+import (
+	"encoding/json"
+
+	"github.com/valyala/fasthttp"
+)
+
+// kucoinError mirrors the error body of the exchange, so bots handle rejections of the proxy like its own.
+type kucoinError struct {
+	Code string `json:"code"`
+	Msg  string `json:"msg"`
+}
+
+// WriteError writes an exchange style error response.
+func WriteError(ctx *fasthttp.RequestCtx, statusCode int, code string, msg string) {
+	data, _ := json.Marshal(kucoinError{Code: code, Msg: msg})
+
+	ctx.Response.Reset()
+	ctx.Response.SetStatusCode(statusCode)
+	ctx.Response.Header.SetContentTypeBytes(contentTypeBytes)
+	ctx.Response.SetBody(data)
+}
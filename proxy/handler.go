@@ -2,12 +2,18 @@ package proxy
 
 import (
 	"bytes"
+	"io"
 	"net/http"
+	"sort"
+	"strings"
+	"time"
 
 	routing "github.com/qiangxue/fasthttp-routing"
 	"github.com/sirupsen/logrus"
 	"github.com/stash86/kucoin-proxy/store"
+	"github.com/stash86/kucoin-proxy/tracing"
 	"github.com/valyala/fasthttp"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 var (
@@ -16,58 +22,189 @@ var (
 	gzipHeaderBytes            = []byte("gzip")
 )
 
+const etagVariant = "etag"
+
 type RequestURIFn func(c *routing.Context) string
 
-func TransparentHandler(requestURIFn func(c *routing.Context) string, client *Client) func(c *routing.Context) error {
+func TransparentHandler(requestURIFn func(c *routing.Context) string, client *Client, opts ...PassthroughOption) func(c *routing.Context) error {
+	filter := &passthroughFilter{}
+	for _, opt := range opts {
+		opt(filter)
+	}
+
 	return func(c *routing.Context) error {
 		logrus.Debugf("proxying over - %s", c.Request.RequestURI())
 
+		uri := requestURIFn(c)
+
 		req := fasthttp.AcquireRequest()
 		defer fasthttp.ReleaseRequest(req)
-		c.Request.Header.CopyTo(&req.Header)
+		req.SetRequestURI(uri)
 
-		req.SetRequestURI(requestURIFn(c))
+		if method, path := string(c.Method()), string(req.URI().Path()); !filter.allowed(method, path) {
+			rejectPassthrough(c.RequestCtx, method, path)
+			return nil
+		}
 
+		if !TakeUpstream(c.RequestCtx) {
+			return nil
+		}
+		CountUpstream(c.RequestCtx)
+
+		client.upstreamRequest(c, req, uri)
 		req.SetBody(c.Request.Body())
 
+		// only passed through bodies are streamed, the ones parsed or cached are read in full so a failed read
+		// is an error rather than a body
 		resp := fasthttp.AcquireResponse()
-		defer fasthttp.ReleaseResponse(resp)
-		if err := client.Do(req, resp); err != nil {
+		resp.StreamBody = true
+		if err := client.DoContext(c.RequestCtx, req, resp); err != nil {
+			fasthttp.ReleaseResponse(resp)
 			logrus.Error(err)
 			return err
 		}
 
-		resp.Header.CopyTo(&c.Response.Header)
+		copyResponseHeaders(resp, &c.Response.Header)
 		c.Response.SetStatusCode(resp.StatusCode())
+
+		// a streamed body is copied to the client as it arrives, the response is released once it is sent
+		if stream := resp.BodyStream(); stream != nil {
+			c.Response.SetBodyStream(&releasingBody{Reader: stream, resp: resp}, resp.Header.ContentLength())
+			return nil
+		}
+
 		c.Response.SetBody(resp.Body())
+		fasthttp.ReleaseResponse(resp)
 
 		return nil
 	}
 }
 
-func TransparentOverCacheHandler(requestURIFn RequestURIFn, client *Client, store *store.TTLCache) func(c *routing.Context) error {
+// releasingBody releases the upstream response after the server is done with its body stream.
+type releasingBody struct {
+	io.Reader
+	resp *fasthttp.Response
+}
+
+func (b *releasingBody) Close() error {
+	err := b.resp.CloseBodyStream()
+	fasthttp.ReleaseResponse(b.resp)
+
+	return err
+}
+
+// ownedBody returns the upstream body in a buffer of its own, which outlives the pooled response.
+func ownedBody(resp *fasthttp.Response) ([]byte, error) {
+	if stream := resp.BodyStream(); stream != nil {
+		return io.ReadAll(stream)
+	}
+
+	return append([]byte(nil), resp.Body()...), nil
+}
+
+// CacheKeyFn derives the TTL cache key of a request.
+type CacheKeyFn func(c *routing.Context) string
+
+// NormalizedCacheKey keys requests on their path and sorted query args followed by the values of headers.
+// Only the listed args are kept, all of them if args is nil.
+func NormalizedCacheKey(args []string, headers []string) CacheKeyFn {
+	keepAll := args == nil
+	keep := make(map[string]bool, len(args))
+	for _, arg := range args {
+		keep[arg] = true
+	}
+
+	return func(c *routing.Context) string {
+		pairs := make([]string, 0, c.QueryArgs().Len())
+		c.QueryArgs().VisitAll(func(key, value []byte) {
+			if keepAll || keep[string(key)] {
+				pairs = append(pairs, string(key)+"="+string(value))
+			}
+		})
+		sort.Strings(pairs)
+
+		var key strings.Builder
+		key.Write(c.Path())
+		if len(pairs) > 0 {
+			key.WriteByte('?')
+			key.WriteString(strings.Join(pairs, "&"))
+		}
+		for _, header := range headers {
+			key.WriteString("|" + header + "=")
+			key.Write(c.Request.Header.Peek(header))
+		}
+
+		return key.String()
+	}
+}
+
+type cacheOptions struct {
+	ttl   time.Duration
+	keyFn CacheKeyFn
+}
+
+// CacheOption tunes the caching of TransparentOverCacheHandler.
+type CacheOption func(options *cacheOptions)
+
+// WithTTL caches the responses of the route for ttl instead of the cache wide timeout.
+func WithTTL(ttl time.Duration) CacheOption {
+	return func(options *cacheOptions) {
+		options.ttl = ttl
+	}
+}
+
+// WithCacheKey keys the cached responses of the route with fn instead of all of its sorted query args.
+func WithCacheKey(fn CacheKeyFn) CacheOption {
+	return func(options *cacheOptions) {
+		options.keyFn = fn
+	}
+}
+
+func TransparentOverCacheHandler(requestURIFn RequestURIFn, client *Client, store *store.TTLCache, opts ...CacheOption) func(c *routing.Context) error {
+	options := &cacheOptions{keyFn: NormalizedCacheKey(nil, nil)}
+	for _, opt := range opts {
+		opt(options)
+	}
+
 	return func(c *routing.Context) (err error) {
 		logrus.Debugf("proxying over - %s", c.Request.RequestURI())
 
-		container := store.Get(string(c.Request.RequestURI()))
+		key := options.keyFn(c)
+
+		_, span := tracing.Start(c.RequestCtx, "ttlcache.Get")
+		container := store.Get(key)
+		span.SetAttributes(attribute.Bool("cache.hit", container != nil))
+		span.End()
+
 		if container != nil {
+			SetCacheOutcome(c.RequestCtx, CacheHit)
 			c.Response.SetStatusCode(http.StatusOK)
-			c.Response.SetBody(container.Raw())
 			c.Response.Header.SetContentTypeBytes(contentTypeBytes)
-			c.Response.Header.SetContentLength(len(container.Raw()))
 
+			etag := string(container.Variant(etagVariant, func(raw []byte) []byte { return []byte(ETag(raw)) }))
+			if NotModified(c, etag, container.StoredAt()) {
+				return nil
+			}
+
+			setCachedBody(c, container)
+
+			return nil
+		}
+
+		SetCacheOutcome(c.RequestCtx, CacheMiss)
+		if !TakeUpstream(c.RequestCtx) {
 			return nil
 		}
+		CountUpstream(c.RequestCtx)
 
 		req := fasthttp.AcquireRequest()
 		defer fasthttp.ReleaseRequest(req)
-		c.Request.Header.CopyTo(&req.Header)
-		req.SetRequestURI(requestURIFn(c))
+		client.upstreamRequest(c, req, requestURIFn(c))
 		req.SetBody(c.Request.Body())
 
 		resp := fasthttp.AcquireResponse()
 		defer fasthttp.ReleaseResponse(resp)
-		if err := client.Do(req, resp); err != nil {
+		if err := client.DoContext(c.RequestCtx, req, resp); err != nil {
 			logrus.Error(err)
 			return err
 		}
@@ -80,15 +217,25 @@ func TransparentOverCacheHandler(requestURIFn RequestURIFn, client *Client, stor
 				return err
 			}
 		} else {
-			data = resp.Body()
+			data, err = ownedBody(resp)
+			if err != nil {
+				return err
+			}
 		}
 
-		store.Store(string(c.Request.RequestURI()), data)
+		if resp.StatusCode() == http.StatusOK {
+			if options.ttl > 0 {
+				store.StoreFor(key, data, options.ttl)
+			} else {
+				store.Store(key, data)
+			}
+		}
 
 		c.Response.Header.SetContentTypeBytes(contentTypeBytes)
 		c.Response.Header.SetContentLength(len(data))
 		c.Response.SetStatusCode(resp.StatusCode())
-		c.Response.SetBody(data)
+		// data is never modified once cached, so it is shared instead of copied
+		c.Response.SetBodyRaw(data)
 
 		return nil
 	}
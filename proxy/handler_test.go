@@ -0,0 +1,213 @@
+package proxy_test
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	routing "github.com/qiangxue/fasthttp-routing"
+	"github.com/stash86/kucoin-proxy/proxy"
+	"github.com/stash86/kucoin-proxy/store"
+	"github.com/stash86/kucoin-proxy/tracing"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestNormalizedCacheKey(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		args    []string
+		headers []string
+		uri     string
+		want    string
+	}{
+		{name: "sorted", uri: "/a?b=2&a=1", want: "/a?a=1&b=2"},
+		{name: "kept args", args: []string{"market"}, uri: "/a?_=123&market=BTC", want: "/a?market=BTC"},
+		{name: "no args", args: []string{}, uri: "/a?_=123", want: "/a"},
+		{name: "headers", args: []string{}, headers: []string{"Accept-Language"}, uri: "/a", want: "/a|Accept-Language=en"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := &fasthttp.RequestCtx{}
+			ctx.Request.SetRequestURI(tc.uri)
+			ctx.Request.Header.Set("Accept-Language", "en")
+
+			if got := proxy.NormalizedCacheKey(tc.args, tc.headers)(&routing.Context{RequestCtx: ctx}); got != tc.want {
+				t.Errorf("key = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestTransparentOverCacheHandler(t *testing.T) {
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+
+	calls := 0
+	go fasthttp.Serve(ln, func(ctx *fasthttp.RequestCtx) { //nolint:errcheck
+		calls++
+		ctx.SetBodyString(`{"code":"200000"}`)
+	})
+
+	client := &proxy.Client{Client: fasthttp.Client{Dial: func(string) (net.Conn, error) { return ln.Dial() }}}
+	cache := store.NewTTLCache(time.Minute)
+
+	handler := proxy.TransparentOverCacheHandler(
+		func(c *routing.Context) string { return "http://upstream" + string(c.Path()) },
+		client,
+		cache,
+		proxy.WithCacheKey(proxy.NormalizedCacheKey([]string{"market"}, nil)),
+	)
+
+	for _, uri := range []string{"/symbols?market=USDS&_=1", "/symbols?_=2&market=USDS"} {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.SetRequestURI(uri)
+		if err := handler(&routing.Context{RequestCtx: ctx}); err != nil {
+			t.Fatal(err)
+		}
+		if got := string(ctx.Response.Body()); got != `{"code":"200000"}` {
+			t.Errorf("body = %s", got)
+		}
+	}
+
+	for _, encoding := range []string{"gzip", "br"} {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.SetRequestURI("/symbols?market=USDS")
+		ctx.Request.Header.Set("Accept-Encoding", encoding)
+		if err := handler(&routing.Context{RequestCtx: ctx}); err != nil {
+			t.Fatal(err)
+		}
+		if got := string(ctx.Response.Header.ContentEncoding()); got != encoding {
+			t.Errorf("content encoding = %q, want %q", got, encoding)
+		}
+		body, err := ctx.Response.BodyUncompressed()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != `{"code":"200000"}` {
+			t.Errorf("%s body = %s", encoding, body)
+		}
+	}
+
+	if calls != 1 {
+		t.Errorf("upstream calls = %d, want 1", calls)
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	data := []byte(`{"code":"200000"}`)
+	etag := proxy.ETag(data)
+	lastModified := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, tc := range []struct {
+		name    string
+		headers map[string]string
+		want    bool
+	}{
+		{name: "unconditional", want: false},
+		{name: "matching etag", headers: map[string]string{"If-None-Match": `"other", W/` + etag}, want: true},
+		{name: "changed etag", headers: map[string]string{"If-None-Match": `"other"`}, want: false},
+		{name: "not modified since", headers: map[string]string{"If-Modified-Since": "Mon, 01 Jan 2024 00:00:00 GMT"}, want: true},
+		{name: "modified since", headers: map[string]string{"If-Modified-Since": "Sun, 31 Dec 2023 00:00:00 GMT"}, want: false},
+		{name: "etag wins", headers: map[string]string{"If-None-Match": `"other"`, "If-Modified-Since": "Mon, 01 Jan 2024 00:00:00 GMT"}, want: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := &fasthttp.RequestCtx{}
+			for k, v := range tc.headers {
+				ctx.Request.Header.Set(k, v)
+			}
+
+			if got := proxy.NotModified(&routing.Context{RequestCtx: ctx}, etag, lastModified); got != tc.want {
+				t.Errorf("NotModified = %v, want %v", got, tc.want)
+			}
+			if got := string(ctx.Response.Header.Peek("ETag")); got != etag {
+				t.Errorf("ETag = %s, want %s", got, etag)
+			}
+			if tc.want && ctx.Response.StatusCode() != fasthttp.StatusNotModified {
+				t.Errorf("status = %d, want 304", ctx.Response.StatusCode())
+			}
+		})
+	}
+}
+
+func TestTransparentHandlerStreamsBody(t *testing.T) {
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+
+	body := strings.Repeat(`{"symbol":"BTC-USDT"},`, 100_000)
+	go fasthttp.Serve(ln, func(ctx *fasthttp.RequestCtx) { //nolint:errcheck
+		ctx.SetBodyString(body)
+	})
+
+	// the client reads bodies in full, passthrough streams them anyway
+	client := &proxy.Client{Client: fasthttp.Client{Dial: func(string) (net.Conn, error) { return ln.Dial() }}}
+	handler := proxy.TransparentHandler(func(c *routing.Context) string { return "http://upstream" + string(c.Path()) }, client)
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.SetRequestURI("/api/v1/market/allTickers")
+	if err := handler(&routing.Context{RequestCtx: ctx}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !ctx.Response.IsBodyStream() {
+		t.Error("the body was buffered instead of streamed")
+	}
+	if got := ctx.Response.Body(); string(got) != body {
+		t.Errorf("streamed %d bytes, want %d", len(got), len(body))
+	}
+}
+
+func TestTransparentOverCacheHandlerSpans(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+
+	go fasthttp.Serve(ln, func(ctx *fasthttp.RequestCtx) { //nolint:errcheck
+		ctx.SetBodyString(`{"code":"200000"}`)
+	})
+
+	client := &proxy.Client{Client: fasthttp.Client{Dial: func(string) (net.Conn, error) { return ln.Dial() }}}
+	route := proxy.TransparentOverCacheHandler(
+		func(c *routing.Context) string { return "http://upstream" + string(c.Path()) },
+		client,
+		store.NewTTLCache(time.Minute),
+	)
+	handler := tracing.Handler(proxy.CompressHandler(func(ctx *fasthttp.RequestCtx) {
+		if err := route(&routing.Context{RequestCtx: ctx}); err != nil {
+			t.Error(err)
+		}
+	}))
+
+	for range 2 {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.SetRequestURI("/api/v1/currencies")
+		ctx.Request.Header.Set("Accept-Encoding", "gzip")
+		handler(ctx)
+	}
+
+	// the miss is compressed on its way out, the hit by caching the compressed variant of the blob
+	want := []string{
+		"ttlcache.Get", "upstream GET", "compress", "GET /api/v1/currencies",
+		"ttlcache.Get", "compress", "GET /api/v1/currencies",
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != len(want) {
+		t.Fatalf("exported %d spans, want %d", len(spans), len(want))
+	}
+
+	for i, span := range spans {
+		if span.Name != want[i] {
+			t.Errorf("span #%d = %s, want %s", i, span.Name, want[i])
+		}
+		if span.SpanKind != trace.SpanKindServer && !span.Parent.IsValid() {
+			t.Errorf("span #%d %s has no parent", i, span.Name)
+		}
+	}
+}
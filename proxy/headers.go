@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"bytes"
+
+	routing "github.com/qiangxue/fasthttp-routing"
+	"github.com/valyala/fasthttp"
+)
+
+// hopByHopHeaders are meaningful for a single connection only and are never forwarded.
+var hopByHopHeaders = []string{
+	fasthttp.HeaderConnection,
+	"Keep-Alive",
+	fasthttp.HeaderProxyAuthenticate,
+	fasthttp.HeaderProxyAuthorization,
+	fasthttp.HeaderTE,
+	fasthttp.HeaderTrailer,
+	fasthttp.HeaderTransferEncoding,
+	fasthttp.HeaderUpgrade,
+	"Proxy-Connection",
+}
+
+// identityHeaders tell the upstream about the client and its proxies.
+var identityHeaders = []string{
+	"Forwarded",
+	fasthttp.HeaderXForwardedFor,
+	fasthttp.HeaderXForwardedProto,
+	fasthttp.HeaderXForwardedHost,
+	"X-Real-Ip",
+}
+
+// connectionHeaders returns the headers the Connection header names as hop-by-hop in addition to the standard ones.
+func connectionHeaders(connection []byte) []string {
+	headers := make([]string, 0)
+	for _, header := range bytes.Split(connection, []byte(",")) {
+		if header = bytes.TrimSpace(header); len(header) > 0 {
+			headers = append(headers, string(header))
+		}
+	}
+
+	return headers
+}
+
+// upstreamRequest prepares the request to the upstream uri from the client's one: hop-by-hop headers are dropped,
+// the Host is the upstream's and the body comes back unencoded, so that the proxy negotiates its own encoding
+// with the client. X-Forwarded-* headers describe the client when the client is configured to forward them,
+// identity headers are stripped otherwise.
+func (client *Client) upstreamRequest(c *routing.Context, req *fasthttp.Request, uri string) {
+	c.Request.Header.CopyTo(&req.Header)
+	req.SetRequestURI(uri)
+	req.Header.SetHostBytes(req.URI().Host())
+
+	for _, header := range connectionHeaders(c.Request.Header.Peek(fasthttp.HeaderConnection)) {
+		req.Header.Del(header)
+	}
+	for _, header := range hopByHopHeaders {
+		req.Header.Del(header)
+	}
+	req.Header.Del(fasthttp.HeaderAcceptEncoding)
+
+	if !client.ForwardedHeaders {
+		for _, header := range identityHeaders {
+			req.Header.Del(header)
+		}
+		return
+	}
+
+	forwardedFor := c.RemoteIP().String()
+	if prior := c.Request.Header.Peek(fasthttp.HeaderXForwardedFor); len(prior) > 0 {
+		forwardedFor = string(prior) + ", " + forwardedFor
+	}
+	req.Header.Set(fasthttp.HeaderXForwardedFor, forwardedFor)
+	req.Header.SetBytesV(fasthttp.HeaderXForwardedHost, c.Host())
+
+	proto := "http"
+	if c.IsTLS() {
+		proto = "https"
+	}
+	req.Header.Set(fasthttp.HeaderXForwardedProto, proto)
+}
+
+// copyResponseHeaders copies the upstream response headers but the hop-by-hop ones and Content-Length, which
+// is recomputed from the body actually sent.
+func copyResponseHeaders(resp *fasthttp.Response, dst *fasthttp.ResponseHeader) {
+	resp.Header.CopyTo(dst)
+
+	for _, header := range connectionHeaders(resp.Header.Peek(fasthttp.HeaderConnection)) {
+		dst.Del(header)
+	}
+	for _, header := range hopByHopHeaders {
+		dst.Del(header)
+	}
+	dst.Del(fasthttp.HeaderContentLength)
+}
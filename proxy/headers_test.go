@@ -0,0 +1,72 @@
+package proxy_test
+
+import (
+	"net"
+	"testing"
+
+	routing "github.com/qiangxue/fasthttp-routing"
+	"github.com/stash86/kucoin-proxy/proxy"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+func TestTransparentHandlerHeaders(t *testing.T) {
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+
+	upstream := &fasthttp.RequestHeader{}
+	go fasthttp.Serve(ln, func(ctx *fasthttp.RequestCtx) { //nolint:errcheck
+		ctx.Request.Header.CopyTo(upstream)
+		ctx.Response.Header.Set("X-Upstream", "1")
+		ctx.Response.Header.Set("Keep-Alive", "timeout=5")
+		ctx.SetBodyString(`{"code":"200000"}`)
+	})
+
+	for _, forwarded := range []bool{false, true} {
+		client := &proxy.Client{
+			Client:           fasthttp.Client{Dial: func(string) (net.Conn, error) { return ln.Dial() }},
+			ForwardedHeaders: forwarded,
+		}
+		handler := proxy.TransparentHandler(func(c *routing.Context) string { return "http://upstream.example" + string(c.Path()) }, client)
+
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Init(&fasthttp.Request{}, &net.TCPAddr{IP: net.ParseIP("10.0.0.1")}, nil)
+		ctx.Request.SetRequestURI("http://proxy.local:8080/api/v1/timestamp")
+		ctx.Request.Header.Set("Connection", "X-Hop")
+		ctx.Request.Header.Set("X-Hop", "1")
+		ctx.Request.Header.Set("X-Forwarded-For", "192.168.0.1")
+		ctx.Request.Header.Set("Accept-Encoding", "gzip")
+		ctx.Request.Header.Set("KC-API-KEY", "key")
+
+		if err := handler(&routing.Context{RequestCtx: ctx}); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := string(upstream.Host()); got != "upstream.example" {
+			t.Errorf("Host = %q, want upstream.example", got)
+		}
+		for _, header := range []string{"X-Hop", "Accept-Encoding"} {
+			if got := upstream.Peek(header); len(got) > 0 {
+				t.Errorf("%s = %q was forwarded", header, got)
+			}
+		}
+		if got := string(upstream.Peek("KC-API-KEY")); got != "key" {
+			t.Errorf("KC-API-KEY = %q, want key", got)
+		}
+
+		forwardedFor := string(upstream.Peek("X-Forwarded-For"))
+		if forwarded && forwardedFor != "192.168.0.1, 10.0.0.1" {
+			t.Errorf("X-Forwarded-For = %q, want the client appended", forwardedFor)
+		}
+		if !forwarded && forwardedFor != "" {
+			t.Errorf("X-Forwarded-For = %q was not stripped", forwardedFor)
+		}
+
+		if got := string(ctx.Response.Header.Peek("X-Upstream")); got != "1" {
+			t.Errorf("X-Upstream = %q, want 1", got)
+		}
+		if got := ctx.Response.Header.Peek("Keep-Alive"); len(got) > 0 {
+			t.Errorf("Keep-Alive = %q was copied back", got)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package kucoin
+
+import (
+	netHttp "net/http"
+
+	routing "github.com/qiangxue/fasthttp-routing"
+	"github.com/stash86/kucoin-proxy/proxy"
+)
+
+type adminCandle struct {
+	Ts        int64   `json:"ts"`
+	Open      float64 `json:"open"`
+	High      float64 `json:"high"`
+	Low       float64 `json:"low"`
+	Close     float64 `json:"close"`
+	Volume    float64 `json:"volume"`
+	Amount    float64 `json:"amount"`
+	Synthetic bool    `json:"synthetic"`
+}
+
+type adminResult struct {
+	Key    string `json:"key"`
+	Result bool   `json:"result"`
+}
+
+func (http *http) AdminRoutes() []proxy.Route {
+	return []proxy.Route{
+		{
+			Path:   "buckets",
+			Method: netHttp.MethodGet,
+			Handler: func(c *routing.Context) error {
+				return proxy.WriteJSON(c, netHttp.StatusOK, http.store.Buckets())
+			},
+		},
+		{
+			Path:   "buckets/<key>",
+			Method: netHttp.MethodGet,
+			Handler: func(c *routing.Context) error {
+				candles := http.store.Candles(c.Param("key"))
+				if candles == nil {
+					return routing.NewHTTPError(netHttp.StatusNotFound)
+				}
+
+				result := make([]adminCandle, 0, len(candles))
+				for _, candle := range candles {
+					result = append(result, adminCandle{
+						Ts:        candle.Ts.Unix(),
+						Open:      candle.Open,
+						High:      candle.High,
+						Low:       candle.Low,
+						Close:     candle.Close,
+						Volume:    candle.Volume,
+						Amount:    candle.Amount,
+						Synthetic: candle.Synthetic,
+					})
+				}
+
+				return proxy.WriteJSON(c, netHttp.StatusOK, result)
+			},
+		},
+		{
+			Path:   "buckets/<key>",
+			Method: netHttp.MethodDelete,
+			Handler: func(c *routing.Context) error {
+				key := c.Param("key")
+
+				// the next websocket update would bring the bucket back, updates in flight are dropped once unsubscribed
+				if pair, timeframe, ok := parseStoreKey(key); ok {
+					http.subscriber.unsubscribeKLines(pair, timeframe)
+				}
+
+				return proxy.WriteJSON(c, netHttp.StatusOK, adminResult{Key: key, Result: http.store.Evict(key)})
+			},
+		},
+		{
+			Path:   "buckets/<key>/refresh",
+			Method: netHttp.MethodPost,
+			Handler: func(c *routing.Context) error {
+				key := c.Param("key")
+				pair, timeframe, ok := parseStoreKey(key)
+				if !ok {
+					return routing.NewHTTPError(netHttp.StatusBadRequest, "wrong bucket key")
+				}
+
+				if err := http.prefetch(c.RequestCtx, pair, timeframe); err != nil {
+					return routing.NewHTTPError(netHttp.StatusBadGateway, err.Error())
+				}
+
+				return proxy.WriteJSON(c, netHttp.StatusOK, adminResult{Key: key, Result: true})
+			},
+		},
+		{
+			Path:   "subscriptions",
+			Method: netHttp.MethodGet,
+			Handler: func(c *routing.Context) error {
+				return proxy.WriteJSON(c, netHttp.StatusOK, http.subscriber.stats())
+			},
+		},
+		{
+			Path:   "subscriptions/<topic>/resubscribe",
+			Method: netHttp.MethodPost,
+			Handler: func(c *routing.Context) error {
+				topic := c.Param("topic")
+				return proxy.WriteJSON(c, netHttp.StatusOK, adminResult{Key: topic, Result: http.subscriber.resubscribe(topic)})
+			},
+		},
+		{
+			Path:   "ttl",
+			Method: netHttp.MethodGet,
+			Handler: func(c *routing.Context) error {
+				return proxy.WriteJSON(c, netHttp.StatusOK, http.ttlCache.Entries())
+			},
+		},
+		{
+			Path:   "ttl",
+			Method: netHttp.MethodDelete,
+			Handler: func(c *routing.Context) error {
+				key := string(c.QueryArgs().Peek("key"))
+				return proxy.WriteJSON(c, netHttp.StatusOK, adminResult{Key: key, Result: http.ttlCache.Evict(key)})
+			},
+		},
+	}
+}
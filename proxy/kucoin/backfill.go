@@ -0,0 +1,180 @@
+package kucoin
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stash86/kucoin-proxy/model"
+	"github.com/stash86/kucoin-proxy/proxy"
+	"github.com/stash86/kucoin-proxy/store"
+	"github.com/stash86/kucoin-proxy/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// kLinesPageLimit is the maximum amount of candles kucoin returns for a single request.
+const kLinesPageLimit = 1500
+
+// Backfill pages through [from, to) oldest first, handing the candles of every page and the span they cover in full
+// to fn in ascending order.
+// Pages go through getKlines, so they share its rate limiting and retries.
+func (http *http) Backfill(ctx context.Context, pair string, timeframe string, from time.Time, to time.Time, fn func(span store.Span, candles []*model.Candle) error) error {
+	period, ok := timeframeDuration(timeframe)
+	if !ok {
+		return fmt.Errorf("unknown timeframe '%s'", timeframe)
+	}
+
+	for _, requested := range kLinesPages(store.Span{From: from, To: to}, period) {
+		page, err := http.fetchPage(ctx, pair, timeframe, requested)
+		if err != nil {
+			return fmt.Errorf("backfill %w", err)
+		}
+
+		logrus.Infof("backfill %s %s: fetched %d candles for [%s-%s]", pair, timeframe, len(page.candles), page.span.From.Format(time.RFC3339), page.span.To.Format(time.RFC3339))
+
+		if err := fn(page.span, page.candles); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// archived serves closed candles of [from, to] from the archive, fetching only the spans it is missing, in
+// parallel pages.
+func (http *http) archived(ctx context.Context, pair string, timeframe string, from time.Time, to time.Time) (candles []*model.Candle, err error) {
+	ctx, span := tracing.Start(ctx, "archive.Get")
+	defer func() {
+		span.SetAttributes(attribute.Int("store.candles", len(candles)))
+		tracing.End(span, err)
+	}()
+
+	key := storeKey(pair, timeframe)
+	period := timeframeToDuration(timeframe)
+
+	missing, err := http.archive.Missing(key, store.Span{From: from, To: to.Add(period)})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(missing) > 0 {
+		proxy.SetCacheOutcome(ctx, proxy.CachePartial)
+	} else {
+		proxy.SetCacheOutcome(ctx, proxy.CacheHit)
+	}
+
+	for _, gap := range missing {
+		proxy.Log(ctx).Infof("archive miss for %s %s [%d-%d], fetching from remote", pair, timeframe, gap.From.Unix(), gap.To.Unix())
+	}
+
+	pages, err := http.fetchPages(ctx, pair, timeframe, missing)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, page := range pages {
+		if err := http.archive.Store(key, page.span, page.candles...); err != nil {
+			return nil, err
+		}
+	}
+
+	return http.archive.Get(key, from, to)
+}
+
+// archiveClosed archives the candles of a page fetched from kucoin which were closed by the time it was requested.
+func (http *http) archiveClosed(pair string, timeframe string, page kLinesPage) {
+	span := page.span
+	if closed := page.fetchedAt.Add(-timeframeToDuration(timeframe)); closed.Before(span.To) {
+		span.To = closed
+	}
+
+	candles := make([]*model.Candle, 0, len(page.candles))
+	for _, c := range page.candles {
+		if c.Ts.Before(span.To) {
+			candles = append(candles, c)
+		}
+	}
+
+	if err := http.archive.Store(storeKey(pair, timeframe), span, candles...); err != nil {
+		logrus.Errorf("failed archiving %s %s: %v", pair, timeframe, err)
+	}
+}
+
+// gapBackfills are the gaps waiting to be refetched per key, a key being present while its gaps are refetched.
+type gapBackfills struct {
+	l       sync.Mutex
+	pending map[string][]store.Span
+}
+
+// backfillGap refetches a period skipped by the websocket to replace its painted candles. Gaps of a key are
+// refetched one at a time, the ones found meanwhile being merged and queued, so a reconnect storm costs at most
+// a goroutine per key.
+func (http *http) backfillGap(key string, gap store.Span) {
+	pair, timeframe, ok := parseStoreKey(key)
+	if !ok {
+		return
+	}
+
+	http.gaps.l.Lock()
+	if http.gaps.pending == nil {
+		http.gaps.pending = map[string][]store.Span{}
+	}
+	pending, running := http.gaps.pending[key]
+	http.gaps.pending[key] = append(pending, gap)
+	http.gaps.l.Unlock()
+
+	if running {
+		return
+	}
+
+	go func() {
+		for {
+			http.gaps.l.Lock()
+			gaps := mergeSpans(http.gaps.pending[key])
+			if len(gaps) == 0 {
+				delete(http.gaps.pending, key)
+				http.gaps.l.Unlock()
+				return
+			}
+			http.gaps.pending[key] = []store.Span{}
+			http.gaps.l.Unlock()
+
+			period := timeframeToDuration(timeframe)
+			for _, gap := range gaps {
+				logrus.Infof("backfilling gap of %s %s [%d-%d]", pair, timeframe, gap.From.Unix(), gap.To.Unix())
+
+				// pages stop short of the candle closing the gap, so its websocket state is kept
+				for _, requested := range kLinesPages(gap, period) {
+					page, err := http.fetchPage(context.Background(), pair, timeframe, requested)
+					if err != nil {
+						logrus.Warnf("backfilling gap of %s %s failed: %v", pair, timeframe, err)
+						break
+					}
+
+					http.store.Store(key, period, page.candles...)
+				}
+			}
+		}
+	}()
+}
+
+// mergeSpans sorts the spans and joins the ones overlapping or touching.
+func mergeSpans(spans []store.Span) []store.Span {
+	sort.Slice(spans, func(i, j int) bool { return spans[i].From.Before(spans[j].From) })
+
+	merged := make([]store.Span, 0, len(spans))
+	for _, span := range spans {
+		if last := len(merged) - 1; last >= 0 && !span.From.After(merged[last].To) {
+			if span.To.After(merged[last].To) {
+				merged[last].To = span.To
+			}
+			continue
+		}
+		merged = append(merged, span)
+	}
+
+	return merged
+}
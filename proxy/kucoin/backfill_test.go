@@ -0,0 +1,110 @@
+package kucoin_test
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stash86/kucoin-proxy/model"
+	"github.com/stash86/kucoin-proxy/proxy/kucoin"
+	"github.com/stash86/kucoin-proxy/store"
+	"github.com/valyala/fasthttp"
+)
+
+var testTs = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func hours(n int) time.Time {
+	return testTs.Add(time.Duration(n) * time.Hour)
+}
+
+// kLinesBody answers a candles request of [startAt, endAt) with an hourly candle per period, newest first.
+func kLinesBody(ctx *fasthttp.RequestCtx) string {
+	args := ctx.QueryArgs()
+	rows := make([]string, 0)
+	for ts := args.GetUintOrZero("startAt"); ts < args.GetUintOrZero("endAt"); ts += 3600 {
+		rows = append([]string{fmt.Sprintf(`["%d","1","2","3","0.5","10","20"]`, ts)}, rows...)
+	}
+
+	return `{"code":"200000","data":[` + strings.Join(rows, ",") + `]}`
+}
+
+func TestBackfillGapMergesGapsInFlight(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+
+	l := sync.Mutex{}
+	requested := make([]string, 0)
+	first := make(chan struct{})
+	release := make(chan struct{})
+
+	client := upstreamClient(t, func(ctx *fasthttp.RequestCtx) {
+		l.Lock()
+		requested = append(requested, fmt.Sprintf("%s-%s", ctx.QueryArgs().Peek("startAt"), ctx.QueryArgs().Peek("endAt")))
+		n := len(requested)
+		l.Unlock()
+
+		if n == 1 {
+			close(first)
+			<-release
+		}
+		ctx.SetBodyString(kLinesBody(ctx))
+	})
+
+	candles := store.NewStore(100, store.GapSkip)
+	exchange := kucoin.New(candles, nil, store.NewTTLCache(time.Minute), client, testConfig())
+	key := "kucoin-BTC-USDT-1hour"
+
+	kucoin.BackfillGap(exchange, key, store.Span{From: hours(1), To: hours(3)})
+	<-first
+
+	// reported while the first gap is refetched, they are merged into a single request
+	kucoin.BackfillGap(exchange, key, store.Span{From: hours(5), To: hours(7)})
+	kucoin.BackfillGap(exchange, key, store.Span{From: hours(5), To: hours(7)})
+	kucoin.BackfillGap(exchange, key, store.Span{From: hours(6), To: hours(9)})
+	close(release)
+
+	want := []string{
+		fmt.Sprintf("%d-%d", hours(1).Unix(), hours(3).Unix()-1),
+		fmt.Sprintf("%d-%d", hours(5).Unix(), hours(9).Unix()-1),
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(candles.Candles(key)) < 6 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	if fmt.Sprint(requested) != fmt.Sprint(want) {
+		t.Errorf("requested = %v, want %v", requested, want)
+	}
+}
+
+func TestBackfillGapKeepsClosingCandle(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+
+	client := upstreamClient(t, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetBodyString(cappedKLinesBody(ctx, 0))
+	})
+
+	// the candle closing the gap is the forming one, updated by the websocket
+	candles := store.NewStore(100, store.GapSkip)
+	candles.Store(testKey, time.Hour, candleAt(0), &model.Candle{Ts: hours(3), Close: 99, Volume: 1})
+	exchange := kucoin.New(candles, nil, store.NewTTLCache(time.Minute), client, testConfig())
+
+	kucoin.BackfillGap(exchange, testKey, store.Span{From: hours(1), To: hours(3)})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(candles.Candles(testKey)) < 4 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if got := len(candles.Candles(testKey)); got != 4 {
+		t.Fatalf("candles = %d, want the gap filled", got)
+	}
+	if closing := candles.Get(testKey, hours(3), hours(3)); closing[0].Close != 99 {
+		t.Errorf("closing candle close = %v, want the websocket's 99", closing[0].Close)
+	}
+}
@@ -1,13 +1,21 @@
 package kucoin
 
 import (
+	"fmt"
+
 	validation "github.com/go-ozzo/ozzo-validation/v4"
 	"github.com/go-ozzo/ozzo-validation/v4/is"
+	"github.com/stash86/kucoin-proxy/proxy"
 )
 
 type Config struct {
-	KucoinTopicsPerWs int    `help:"amount of topics per ws connection [10-280]"`
-	KucoinApiURL      string `help:"kucoin api address"`
+	KucoinTopicsPerWs      int      `help:"amount of topics per ws connection [10-280]"`
+	KucoinApiURL           string   `help:"kucoin api address"`
+	KucoinWarmupPairs      []string `help:"pairs to prefetch and subscribe at startup, '*-USDT' stands for all trading USDT pairs"`
+	KucoinWarmupTimeframes []string `help:"timeframes to prefetch and subscribe at startup for every warm-up pair"`
+	KucoinPassthroughAllow []string `help:"requests passed through to kucoin as 'METHOD /path' rules, a trailing * matching any suffix. everything is allowed if empty"`
+	KucoinPassthroughDeny  []string `help:"requests rejected instead of being passed through to kucoin as 'METHOD /path' rules, taking precedence over allowed ones"`
+	KucoinFormingCandle    string   `help:"candle of the current period in kline responses: include - its latest state, from the websocket once subscribed, exclude - left out until it closes"`
 	//Localaddr string `help:"local address (use it if you understand what you are doing)"`
 }
 
@@ -15,6 +23,25 @@ func (c Config) Validate() error {
 	return validation.ValidateStruct(&c,
 		validation.Field(&c.KucoinTopicsPerWs, validation.Min(10), validation.Max(280)),
 		validation.Field(&c.KucoinApiURL, is.RequestURL),
+		validation.Field(&c.KucoinWarmupTimeframes, validation.Each(validation.By(validateTimeframe))),
+		validation.Field(&c.KucoinWarmupPairs, validation.When(len(c.KucoinWarmupTimeframes) > 0, validation.Required)),
+		validation.Field(&c.KucoinPassthroughAllow, validation.By(validatePassthroughRules)),
+		validation.Field(&c.KucoinPassthroughDeny, validation.By(validatePassthroughRules)),
+		validation.Field(&c.KucoinFormingCandle, validation.In(FormingInclude, FormingExclude)),
 		//validation.Field(&c.Localaddr, validation.When(c.Localaddr != "", is.IPv4)),
 	)
 }
+
+func validateTimeframe(value interface{}) error {
+	if _, ok := timeframeDuration(value.(string)); !ok {
+		return fmt.Errorf("unknown timeframe '%s'", value)
+	}
+
+	return nil
+}
+
+func validatePassthroughRules(value interface{}) error {
+	_, err := proxy.ParsePassthroughRules(value.([]string))
+
+	return err
+}
@@ -0,0 +1,27 @@
+package kucoin
+
+// WarmupPairs exposes warmupPairs to the tests.
+var WarmupPairs = (*http).warmupPairs
+
+// BackfillGap exposes backfillGap to the tests.
+var BackfillGap = (*http).backfillGap
+
+// ClosedCandles exposes closedCandles to the tests.
+var ClosedCandles = closedCandles
+
+// Subscribed marks the candles of the pair as subscribed, keeping the tests off the websocket.
+func (http *http) Subscribed(pair string, timeframe string) {
+	http.subscriber.l.Lock()
+	defer http.subscriber.l.Unlock()
+
+	http.subscriber.subs[wsTopic(pair, timeframe)] = &subscription{}
+}
+
+// KLinesPages exposes kLinesPages to the tests.
+var KLinesPages = kLinesPages
+
+// MergeCandles exposes mergeCandles to the tests.
+var MergeCandles = mergeCandles
+
+// StoreUpdate exposes storeUpdate to the tests.
+var StoreUpdate = storeUpdate
@@ -0,0 +1,89 @@
+package kucoin
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/mailru/easyjson"
+	routing "github.com/qiangxue/fasthttp-routing"
+	"github.com/sirupsen/logrus"
+	"github.com/stash86/kucoin-proxy/model"
+	"github.com/stash86/kucoin-proxy/proxy"
+	"github.com/stash86/kucoin-proxy/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// FormingInclude responds with the latest state of the candle of the current period known to the proxy.
+	FormingInclude = "include"
+	// FormingExclude leaves the candle of the current period out of responses until it closes.
+	FormingExclude = "exclude"
+
+	candleUpdatedAtHeader = "X-Candle-Updated-At"
+)
+
+// isForming tells whether the candle's period is still open at now.
+func isForming(candle *model.Candle, period time.Duration, now time.Time) bool {
+	return candle.Ts.Add(period).After(now)
+}
+
+// closedCandles drops the candles whose period is still open at now.
+func closedCandles(candles []*model.Candle, period time.Duration, now time.Time) []*model.Candle {
+	closed := make([]*model.Candle, 0, len(candles))
+	for _, c := range candles {
+		if !isForming(c, period, now) {
+			closed = append(closed, c)
+		}
+	}
+
+	return closed
+}
+
+// withoutCachedForming drops from fetched the forming candle the newest first cached candles start with, as the
+// websocket keeps the cached one more current than a snapshot.
+func withoutCachedForming(fetched []*model.Candle, cached []*model.Candle, period time.Duration, now time.Time) []*model.Candle {
+	if len(cached) == 0 || !isForming(cached[0], period, now) {
+		return fetched
+	}
+
+	kept := make([]*model.Candle, 0, len(fetched))
+	for _, c := range fetched {
+		if !c.Ts.Equal(cached[0].Ts) {
+			kept = append(kept, c)
+		}
+	}
+
+	return kept
+}
+
+// writeKLines responds with the candles in the forming candle mode, updatedAt being the last time the
+// candles changed, zero if unknown.
+func (http *http) writeKLines(c *routing.Context, candles []*model.Candle, period time.Duration, updatedAt time.Time) error {
+	if http.config.KucoinFormingCandle == FormingExclude {
+		candles = closedCandles(candles, period, time.Now().UTC())
+	}
+
+	_, span := tracing.Start(c.RequestCtx, "kucoin.encode", attribute.Int("store.candles", len(candles)))
+	data, err := easyjson.Marshal(genericResponse{Code: successCode, Data: candlesJSON(candles)})
+	tracing.End(span, err)
+
+	if err != nil {
+		logrus.Errorf("failed to marshal candles response: %v", err)
+		return err
+	}
+
+	c.SetStatusCode(200)
+	if !updatedAt.IsZero() {
+		c.Response.Header.Set(candleUpdatedAtHeader, strconv.FormatInt(updatedAt.UnixMilli(), 10))
+	}
+
+	// the body changes with every websocket update of the range, so does its hash. Last-Modified is left out, its
+	// seconds would validate updates of the same second
+	if proxy.NotModified(c, proxy.ETag(data), time.Time{}) {
+		return nil
+	}
+
+	c.Response.SetBodyRaw(data)
+
+	return nil
+}
@@ -0,0 +1,135 @@
+package kucoin_test
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stash86/kucoin-proxy/model"
+	"github.com/stash86/kucoin-proxy/proxy/kucoin"
+	"github.com/stash86/kucoin-proxy/store"
+	"github.com/valyala/fasthttp"
+)
+
+type testKLinesResponse struct {
+	Code string     `json:"code"`
+	Data [][]string `json:"data"`
+}
+
+// responseCandles returns the ts and close of the candles of a kline response, newest first.
+func responseCandles(t *testing.T, body []byte) ([]int64, []string) {
+	t.Helper()
+
+	response := &testKLinesResponse{}
+	if err := json.Unmarshal(body, response); err != nil {
+		t.Fatalf("response %s: %v", body, err)
+	}
+
+	ts := make([]int64, 0, len(response.Data))
+	closes := make([]string, 0, len(response.Data))
+	for _, row := range response.Data {
+		value, _ := strconv.ParseInt(row[0], 10, 64)
+		ts = append(ts, value)
+		closes = append(closes, row[2])
+	}
+
+	return ts, closes
+}
+
+func TestClosedCandles(t *testing.T) {
+	now := testTs.Add(3*time.Hour + 30*time.Minute)
+	candles := []*model.Candle{candleAt(3), candleAt(2), candleAt(1)}
+
+	closed := kucoin.ClosedCandles(candles, time.Hour, now)
+	if len(closed) != 2 || closed[0] != candles[1] || closed[1] != candles[2] {
+		t.Errorf("closed = %v, want the candles of hours 2 and 1", closed)
+	}
+
+	// a candle closes at the end of its period
+	if closed := kucoin.ClosedCandles(candles, time.Hour, testTs.Add(4*time.Hour)); len(closed) != 3 {
+		t.Errorf("closed at the end of the period = %d candles, want 3", len(closed))
+	}
+}
+
+func TestKLinesFormingCandle(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+
+	now := time.Now().UTC()
+	current := now.Truncate(time.Hour)
+
+	for _, tc := range []struct {
+		mode string
+		want int
+	}{
+		{mode: kucoin.FormingInclude, want: 3},
+		{mode: kucoin.FormingExclude, want: 2},
+	} {
+		t.Run(tc.mode, func(t *testing.T) {
+			candles := store.NewStore(100, store.GapSkip)
+			for i := 2; i >= 0; i-- {
+				candles.Store(testKey, time.Hour, &model.Candle{Ts: current.Add(-time.Duration(i) * time.Hour), Close: 1, Volume: 1})
+			}
+			candles.Verify(testKey, store.Span{From: current.Add(-2 * time.Hour), To: now})
+
+			config := testConfig()
+			config.KucoinFormingCandle = tc.mode
+			client := upstreamClient(t, func(ctx *fasthttp.RequestCtx) { ctx.SetBodyString(testSymbols) })
+			handler := kLinesRoute(t, kucoin.New(candles, nil, store.NewTTLCache(time.Minute), client, config))
+
+			ctx := getKLines(t, handler, current.Add(-2*time.Hour), now)
+
+			ts, _ := responseCandles(t, ctx.Response.Body())
+			if len(ts) != tc.want {
+				t.Fatalf("candles = %v, want %d", ts, tc.want)
+			}
+			if tc.mode == kucoin.FormingExclude && ts[0] != current.Add(-time.Hour).Unix() {
+				t.Errorf("newest candle = %d, want the last closed one", ts[0])
+			}
+
+			want := strconv.FormatInt(candles.Updated(testKey).UnixMilli(), 10)
+			if got := string(ctx.Response.Header.Peek("X-Candle-Updated-At")); got != want {
+				t.Errorf("X-Candle-Updated-At = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestKLinesPartialMissKeepsFormingCandle(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+
+	now := time.Now().UTC()
+	current := now.Truncate(time.Hour)
+
+	client := upstreamClient(t, func(ctx *fasthttp.RequestCtx) {
+		if !strings.Contains(string(ctx.Path()), "candles") {
+			ctx.SetBodyString(testSymbols)
+			return
+		}
+		ctx.SetBodyString(kLinesBody(ctx))
+	})
+
+	// the websocket has updated the forming candle since it was verified
+	candles := store.NewStore(100, store.GapSkip)
+	candles.Store(testKey, time.Hour, &model.Candle{Ts: current.Add(-6 * time.Hour), Close: 1, Volume: 1})
+	candles.Verify(testKey, store.Span{From: current.Add(-6 * time.Hour), To: current.Add(-5 * time.Hour)})
+	candles.Store(testKey, time.Hour, &model.Candle{Ts: current, Close: 99, Volume: 1})
+
+	exchange := kucoin.New(candles, nil, store.NewTTLCache(time.Minute), client, testConfig())
+	exchange.Subscribed("BTC-USDT", "1hour")
+
+	ctx := getKLines(t, kLinesRoute(t, exchange), current.Add(-6*time.Hour), now)
+
+	ts, closes := responseCandles(t, ctx.Response.Body())
+	if len(ts) != 7 || ts[0] != current.Unix() {
+		t.Fatalf("candles = %v, want 7 up to the forming one", ts)
+	}
+	if closes[0] != "99" {
+		t.Errorf("forming candle close = %s, want the websocket's 99", closes[0])
+	}
+	if stored := candles.Get(testKey, current, current); len(stored) != 1 || stored[0].Close != 99 {
+		t.Errorf("stored forming candle = %+v, want the websocket's", stored)
+	}
+}
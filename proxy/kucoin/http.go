@@ -1,6 +1,8 @@
 package kucoin
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	netHttp "net/http"
 	"sync"
@@ -9,9 +11,11 @@ import (
 	"github.com/mailru/easyjson"
 	routing "github.com/qiangxue/fasthttp-routing"
 	"github.com/sirupsen/logrus"
-	"github.com/spf13/cast"
+	"github.com/stash86/kucoin-proxy/model"
 	"github.com/stash86/kucoin-proxy/proxy"
 	"github.com/stash86/kucoin-proxy/store"
+	"github.com/stash86/kucoin-proxy/tracing"
+	"go.opentelemetry.io/otel/attribute"
 	"go.uber.org/ratelimit"
 )
 
@@ -20,15 +24,18 @@ const (
 	tickersPath    = "api/v1/market/allTickers"
 	currenciesPath = "api/v1/currencies"
 	symbolsPath    = "api/v1/symbols"
+
+	successCode = "200000"
 )
 
-func New(store *store.Store, ttlCache *store.TTLCache, client *proxy.Client, config *Config) *http {
+func New(store *store.Store, archive *store.Archive, ttlCache *store.TTLCache, client *proxy.Client, config *Config) *http {
 	httpRl := ratelimit.New(15)
 
 	instance := &http{
 		config:   config,
 		client:   client,
 		store:    store,
+		archive:  archive,
 		ttlCache: ttlCache,
 		rl:       httpRl,
 		subscriber: &subscriber{
@@ -36,13 +43,16 @@ func New(store *store.Store, ttlCache *store.TTLCache, client *proxy.Client, con
 			pool:   nil,
 			httpRl: httpRl,
 			wsRl:   ratelimit.New(9),
-			subs:   map[string]struct{}{},
+			subs:   map[string]*subscription{},
 			config: config,
 			client: client,
 			store:  store,
 		},
 	}
 
+	store.OnGap(instance.backfillGap)
+	store.OnEvict(instance.unsubscribeEvicted)
+
 	return instance
 }
 
@@ -50,39 +60,67 @@ type http struct {
 	client *proxy.Client
 
 	store    *store.Store
+	archive  *store.Archive
 	ttlCache *store.TTLCache
 	rl       ratelimit.Limiter
+	symbols  symbolSet
+	gaps     gapBackfills
 
 	subscriber *subscriber
 	config     *Config
 }
 
-func (http *http) executeKLinesRequest(pair string, timeframe string, startAt int64, endAt int64) (int, *kLinesResponse, []byte, error) {
+// unsubscribeEvicted stops the websocket updates of a bucket evicted from the store.
+func (http *http) unsubscribeEvicted(key string) {
+	pair, timeframe, ok := parseStoreKey(key)
+	if !ok {
+		return
+	}
+
+	go http.subscriber.unsubscribeKLines(pair, timeframe)
+}
+
+func (http *http) executeKLinesRequest(ctx context.Context, pair string, timeframe string, startAt int64, endAt int64) (int, *kLinesResponse, []byte, error) {
 	path := fmt.Sprintf("%s/%s?type=%s&symbol=%s&startAt=%d&endAt=%d", http.config.KucoinApiURL, kLinesPath, timeframe, pair, startAt, endAt)
 
-	statusCode, data, err := http.client.Get(nil, path)
+	proxy.CountUpstream(ctx)
+	statusCode, data, err := http.client.GetContext(ctx, nil, path)
 	if err != nil {
-		logrus.Errorf("executeKLinesRequest: HTTP request failed for %s: %v", path, err)
+		proxy.Log(ctx).Errorf("executeKLinesRequest: HTTP request failed for %s: %v", path, err)
 		return statusCode, nil, nil, err
 	}
 
 	kLinesResponse := &kLinesResponse{}
 	if err := easyjson.Unmarshal(data, kLinesResponse); err != nil {
-		logrus.Errorf("executeKLinesRequest: failed to unmarshal response for %s: %v", path, err)
+		proxy.Log(ctx).Errorf("executeKLinesRequest: failed to unmarshal response for %s: %v", path, err)
 		return statusCode, nil, data, err
 	}
 
 	return statusCode, kLinesResponse, data, nil
 }
 
-func (http *http) getKlines(pair string, timeframe string, startAt int64, endAt int64, retryCount int) (int, *kLinesResponse, []byte, error) {
+// getKlines fetches candles from kucoin with retries, ctx being the request they are fetched for, if any.
+func (http *http) getKlines(ctx context.Context, pair string, timeframe string, startAt int64, endAt int64, retryCount int) (statusCode int, response *kLinesResponse, data []byte, err error) {
+	ctx, span := tracing.Start(ctx, "kucoin.getKlines",
+		attribute.String("kucoin.symbol", pair),
+		attribute.String("kucoin.type", timeframe),
+		attribute.Int64("kucoin.start_at", startAt),
+		attribute.Int64("kucoin.end_at", endAt),
+	)
+	defer func() { tracing.End(span, err) }()
+
 	for i := 1; i <= retryCount; i++ {
+		span.SetAttributes(attribute.Int("kucoin.attempts", i))
+
+		_, wait := tracing.Start(ctx, "ratelimit.Take")
 		http.rl.Take()
+		wait.End()
 
-		if statusCode, kLinesResponse, data, err := http.executeKLinesRequest(pair, timeframe, startAt, endAt); statusCode == 200 {
+		// a body which fails to parse, e.g. a read cut short, is retried as any failed attempt
+		if statusCode, kLinesResponse, data, err := http.executeKLinesRequest(ctx, pair, timeframe, startAt, endAt); statusCode == 200 && err == nil {
 			return statusCode, kLinesResponse, data, nil
 		} else {
-			logrus.Warnf("getKlines: attempt %d/%d failed for %s %s %d %d: %v", i, retryCount, pair, timeframe, startAt, endAt, err)
+			proxy.Log(ctx).Warnf("getKlines: attempt %d/%d failed for %s %s %d %d: %v", i, retryCount, pair, timeframe, startAt, endAt, err)
 			if i == retryCount {
 				return statusCode, kLinesResponse, data, fmt.Errorf("get klines request '%s' '%s' '%d' '%d' exceeded retry '%d' attemts: %w", pair, timeframe, startAt, endAt, retryCount, err)
 			}
@@ -94,10 +132,65 @@ func (http *http) getKlines(pair string, timeframe string, startAt int64, endAt
 	return 500, nil, nil, fmt.Errorf("retry count is zero")
 }
 
+// kLinesOutcome tells, for cached candles covering the request, whether the websocket updated a range reaching
+// the current candle within the last period.
+func kLinesOutcome(endAtAfterNow bool, updated time.Time, period time.Duration) proxy.CacheOutcome {
+	if endAtAfterNow && time.Since(updated) > period {
+		return proxy.CacheStale
+	}
+
+	return proxy.CacheHit
+}
+
+// kLinesWindow is the span the store has to have verified to answer the request from memory. It stops a period
+// before now, the candles since being the forming one which the websocket keeps updating.
+func kLinesWindow(query kLinesQuery, now time.Time) store.Span {
+	// endAt is inclusive and timestamps are whole seconds
+	window := store.Span{From: query.startAt, To: query.endAt.Add(time.Second)}
+	if closed := now.Add(-query.period); closed.Before(window.To) {
+		window.To = closed
+	}
+
+	return window
+}
+
+// kLinesSpans are the spans to fetch for the request, the missing parts of its window, the last one reaching to
+// endAt when the window stops short of it.
+func kLinesSpans(query kLinesQuery, window store.Span, missing []store.Span) []store.Span {
+	end := query.endAt.Add(time.Second)
+	if len(missing) == 0 {
+		return []store.Span{{From: query.startAt, To: end}}
+	}
+
+	spans := append([]store.Span{}, missing...)
+	if last := &spans[len(spans)-1]; last.To.Equal(window.To) {
+		last.To = end
+	}
+
+	return spans
+}
+
+// writePageError answers a failed page as kucoin answered it.
+func (http *http) writePageError(c *routing.Context, err *kLinesPageError) error {
+	proxy.Log(c.RequestCtx).Warnf("kLines fetch failed: %v", err)
+	c.Response.SetStatusCode(err.statusCode)
+	c.Response.SetBodyRaw(err.data)
+
+	return nil
+}
+
 func (http *http) transparentRequestURI(c *routing.Context) string {
 	return fmt.Sprintf("%s/%s", http.config.KucoinApiURL, c.Request.URI().RequestURI()[8:])
 }
 
+// passthroughRules are validated along with the config.
+func (http *http) passthroughRules() proxy.PassthroughOption {
+	allow, _ := proxy.ParsePassthroughRules(http.config.KucoinPassthroughAllow)
+	deny, _ := proxy.ParsePassthroughRules(http.config.KucoinPassthroughDeny)
+
+	return proxy.WithPassthroughRules(allow, deny)
+}
+
 func (http *http) Name() string {
 	return "kucoin"
 }
@@ -107,17 +200,17 @@ func (http *http) Routes() []proxy.Route {
 		{
 			Path:    tickersPath,
 			Method:  netHttp.MethodGet,
-			Handler: proxy.TransparentOverCacheHandler(http.transparentRequestURI, http.client, http.ttlCache),
+			Handler: proxy.TransparentOverCacheHandler(http.transparentRequestURI, http.client, http.ttlCache, proxy.WithCacheKey(proxy.NormalizedCacheKey([]string{}, nil))),
 		},
 		{
 			Path:    currenciesPath,
 			Method:  netHttp.MethodGet,
-			Handler: proxy.TransparentOverCacheHandler(http.transparentRequestURI, http.client, http.ttlCache),
+			Handler: proxy.TransparentOverCacheHandler(http.transparentRequestURI, http.client, http.ttlCache, proxy.WithCacheKey(proxy.NormalizedCacheKey([]string{}, nil))),
 		},
 		{
 			Path:    symbolsPath,
 			Method:  netHttp.MethodGet,
-			Handler: proxy.TransparentOverCacheHandler(http.transparentRequestURI, http.client, http.ttlCache),
+			Handler: proxy.TransparentOverCacheHandler(http.transparentRequestURI, http.client, http.ttlCache, proxy.WithCacheKey(proxy.NormalizedCacheKey([]string{"market"}, nil))),
 		},
 		{
 			Path:   kLinesPath,
@@ -125,63 +218,121 @@ func (http *http) Routes() []proxy.Route {
 			Handler: func(c *routing.Context) error {
 				logrus.Debugf("proxying - %s", c.Request.RequestURI())
 
-				pair := string(c.Request.URI().QueryArgs().Peek("symbol"))
-				timeframe := string(c.Request.URI().QueryArgs().Peek("type"))
-				startAt := time.Unix(cast.ToInt64(string(c.Request.URI().QueryArgs().Peek("startAt"))), 0)
-				endAt := time.Unix(cast.ToInt64(string(c.Request.URI().QueryArgs().Peek("endAt"))), 0)
-				endAtAfterNow := endAt.After(time.Now().UTC().Add(-timeframeToDuration(timeframe)))
+				query, err := parseKLinesQuery(c.Request.URI().QueryArgs(), time.Now().UTC())
+				if err != nil {
+					proxy.WriteError(c.RequestCtx, netHttp.StatusBadRequest, parameterErrorCode, err.Error())
+					return nil
+				}
 
-				candles := http.store.Get(storeKey(pair, timeframe), startAt, endAt)
+				// unknown symbols never reach the store, the archive or the websocket. When the symbols can't be
+				// fetched, the candles are passed on from kucoin without being kept
+				known, err := http.knownSymbol(c.RequestCtx, query.pair)
+				checked := err == nil
+				if !checked {
+					proxy.Log(c.RequestCtx).Warnf("kLines symbol check of '%s' skipped, not caching: %v", query.pair, err)
+				} else if !known {
+					proxy.WriteError(c.RequestCtx, netHttp.StatusBadRequest, parameterErrorCode, fmt.Sprintf("unknown symbol '%s'", query.pair))
+					return nil
+				}
 
-				if len(candles) == 0 {
-					logrus.Infof("kLines cache miss for %s %s [%d-%d], fetching from remote", pair, timeframe, startAt.Unix(), endAt.Unix())
-					statusCode, klinesResponse, data, err := http.getKlines(pair, timeframe, startAt.Unix(), endAt.Unix(), 15)
+				pair, timeframe, startAt, endAt := query.pair, query.timeframe, query.startAt, query.endAt
+				key := storeKey(pair, timeframe)
+				now := time.Now().UTC()
+				endAtAfterNow := endAt.After(now.Add(-query.period))
+				window := kLinesWindow(query, now)
+
+				_, span := tracing.Start(c.RequestCtx, "store.Get")
+				candles := http.store.Get(key, startAt, endAt)
+				missing := http.store.Missing(key, window)
+				span.SetAttributes(attribute.Int("store.candles", len(candles)), attribute.Int("store.missing", len(missing)))
+				span.End()
+				updated := http.store.Updated(key)
 
-					c.Response.SetStatusCode(statusCode)
-					c.Response.SetBody(data)
+				if len(candles) > 0 && len(missing) == 0 {
+					proxy.SetCacheOutcome(c.RequestCtx, kLinesOutcome(endAtAfterNow, updated, query.period))
+					logrus.Debugf("kLines cache hit for %s %s [%d-%d]", pair, timeframe, startAt.Unix(), endAt.Unix())
+
+					return http.writeKLines(c, candles, query.period, updated)
+				}
+
+				if len(candles) == 0 {
+					proxy.SetCacheOutcome(c.RequestCtx, proxy.CacheMiss)
+				} else {
+					proxy.SetCacheOutcome(c.RequestCtx, proxy.CachePartial)
+				}
+				if !proxy.TakeUpstream(c.RequestCtx) {
+					return nil
+				}
 
-					if statusCode == 429 {
-						return nil
+				if len(candles) == 0 && http.archive != nil && !endAtAfterNow && checked {
+					// the archive fetched what it missed, so its candles are all there is even when there are none
+					archived, err := http.archived(c.RequestCtx, pair, timeframe, startAt, endAt)
+					if err == nil {
+						return http.writeKLines(c, archived, query.period, updated)
 					}
 
-					if len(klinesResponse.Klines) == 0 {
-						logrus.Warnf("there is no candle data from kucoin for - '%s'", c.Request.RequestURI())
+					pageErr := &kLinesPageError{}
+					if errors.As(err, &pageErr) {
+						return http.writePageError(c, pageErr)
 					}
 
-					if endAtAfterNow {
-						http.store.Store(
-							storeKey(pair, timeframe),
-							timeframeToDuration(timeframe),
-							parseKLines(klinesResponse.Klines)...,
-						)
+					proxy.Log(c.RequestCtx).Errorf("kLines archive failed for %s %s [%d-%d]: %v", pair, timeframe, startAt.Unix(), endAt.Unix(), err)
+				}
 
-						if err == nil {
-							logrus.Debugf("subscribing to kLines for %s %s", pair, timeframe)
-							go http.subscriber.subscribeKLines(pair, timeframe)
-						}
+				spans := kLinesSpans(query, window, missing)
+				proxy.Log(c.RequestCtx).Infof("kLines cache miss for %s %s [%d-%d] of client '%s', fetching %d spans from remote", pair, timeframe, startAt.Unix(), endAt.Unix(), proxy.ClientName(c.RequestCtx), len(spans))
+				pages, err := http.fetchPages(c.RequestCtx, pair, timeframe, spans)
+				fetchedAt := time.Now().UTC()
+
+				if err != nil {
+					pageErr := &kLinesPageError{}
+					if !errors.As(err, &pageErr) {
+						return err
 					}
 
-					return nil
+					return http.writePageError(c, pageErr)
 				}
 
-				logrus.Debugf("kLines cache hit for %s %s [%d-%d]", pair, timeframe, startAt.Unix(), endAt.Unix())
-				data, err := easyjson.Marshal(genericResponse{Code: "200000", Data: candlesJSON(candles)})
+				fetched := make([]*model.Candle, 0)
+				for _, page := range pages {
+					fetched = append(fetched, page.candles...)
 
-				if err != nil {
-					logrus.Errorf("failed to marshal candles response: %v", err)
-					return err
+					if http.archive != nil && checked {
+						http.archiveClosed(pair, timeframe, page)
+					}
 				}
+				if len(fetched) == 0 {
+					logrus.Warnf("there is no candle data from kucoin for - '%s'", c.Request.RequestURI())
+				}
+
+				// pages never overlap, merging only sorts them newest first
+				fetched = mergeCandles(nil, fetched)
 
-				c.SetStatusCode(200)
-				c.SetBody(data)
+				if endAtAfterNow && checked {
+					// the snapshot of the forming candle is what the websocket updates from on, unless it does already
+					http.store.Store(key, query.period, withoutCachedForming(fetched, candles, query.period, fetchedAt)...)
+
+					// a page holds every candle up to the time it was requested at
+					for _, page := range pages {
+						verified := page.span
+						if page.fetchedAt.Before(verified.To) {
+							verified.To = page.fetchedAt
+						}
+						http.store.Verify(key, verified)
+					}
+
+					logrus.Debugf("subscribing to kLines for %s %s", pair, timeframe)
+					go http.subscriber.subscribeKLines(pair, timeframe)
+				}
 
-				return err
+				// cached candles win, the forming one being kept current by the websocket
+				return http.writeKLines(c, mergeCandles(fetched, candles), query.period, fetchedAt)
 			},
 		},
 		{
 			Path:    "*",
 			Method:  proxy.AnyHTTPMethod,
-			Handler: proxy.TransparentHandler(http.transparentRequestURI, http.client),
+			Handler: proxy.TransparentHandler(http.transparentRequestURI, http.client, http.passthroughRules()),
 		},
 	}
 }
@@ -0,0 +1,185 @@
+package kucoin_test
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	routing "github.com/qiangxue/fasthttp-routing"
+	"github.com/sirupsen/logrus"
+	"github.com/stash86/kucoin-proxy/model"
+	"github.com/stash86/kucoin-proxy/proxy"
+	"github.com/stash86/kucoin-proxy/proxy/kucoin"
+	"github.com/stash86/kucoin-proxy/store"
+	"github.com/valyala/fasthttp"
+)
+
+const testKey = "kucoin-BTC-USDT-1hour"
+
+func candleAt(n int) *model.Candle {
+	return &model.Candle{Ts: hours(n), Open: float64(n), Close: float64(n), High: float64(n), Low: float64(n), Volume: 1}
+}
+
+// kLinesRoute returns the candles route of the exchange.
+func kLinesRoute(t *testing.T, exchange proxy.Routable) routing.Handler {
+	t.Helper()
+
+	for _, route := range exchange.Routes() {
+		if route.Path == "api/v1/market/candles" {
+			return route.Handler
+		}
+	}
+
+	t.Fatal("no candles route")
+
+	return nil
+}
+
+// getKLines requests the candles of BTC-USDT 1hour in [startAt, endAt], headers being name and value pairs.
+func getKLines(t *testing.T, handler routing.Handler, startAt time.Time, endAt time.Time, headers ...string) *fasthttp.RequestCtx {
+	t.Helper()
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.SetRequestURI(fmt.Sprintf("/kucoin/api/v1/market/candles?symbol=BTC-USDT&type=1hour&startAt=%d&endAt=%d", startAt.Unix(), endAt.Unix()))
+	for i := 0; i+1 < len(headers); i += 2 {
+		ctx.Request.Header.Set(headers[i], headers[i+1])
+	}
+
+	if err := handler(&routing.Context{RequestCtx: ctx}); err != nil {
+		t.Fatal(err)
+	}
+
+	return ctx
+}
+
+func TestKLinesValidators(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+
+	client := upstreamClient(t, func(ctx *fasthttp.RequestCtx) { ctx.SetBodyString(testSymbols) })
+	candles := store.NewStore(100, store.GapSkip)
+	candles.Store(testKey, time.Hour, candleAt(3), candleAt(2), candleAt(1), candleAt(0))
+	candles.Verify(testKey, store.Span{From: hours(0), To: hours(4)})
+
+	handler := kLinesRoute(t, kucoin.New(candles, nil, store.NewTTLCache(time.Minute), client, testConfig()))
+
+	ctx := getKLines(t, handler, hours(0), hours(3))
+	etag := string(ctx.Response.Header.Peek(fasthttp.HeaderETag))
+	if ctx.Response.StatusCode() != http.StatusOK || etag == "" {
+		t.Fatalf("status = %d, etag = %q", ctx.Response.StatusCode(), etag)
+	}
+	if lastModified := ctx.Response.Header.Peek(fasthttp.HeaderLastModified); len(lastModified) > 0 {
+		t.Errorf("Last-Modified = %s, want none", lastModified)
+	}
+	if updatedAt := ctx.Response.Header.Peek("X-Candle-Updated-At"); len(updatedAt) == 0 {
+		t.Error("X-Candle-Updated-At is missing")
+	}
+
+	// an update within the second of If-Modified-Since must not be answered with 304
+	ctx = getKLines(t, handler, hours(0), hours(3), fasthttp.HeaderIfModifiedSince, time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	if ctx.Response.StatusCode() != http.StatusOK || len(ctx.Response.Body()) == 0 {
+		t.Errorf("If-Modified-Since: status = %d, body = %d bytes", ctx.Response.StatusCode(), len(ctx.Response.Body()))
+	}
+
+	ctx = getKLines(t, handler, hours(0), hours(3), fasthttp.HeaderIfNoneMatch, etag)
+	if ctx.Response.StatusCode() != http.StatusNotModified {
+		t.Errorf("If-None-Match: status = %d, want 304", ctx.Response.StatusCode())
+	}
+}
+
+func TestKLinesArchiveTakesUpstreamBudget(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+
+	requests := 0
+	client := upstreamClient(t, func(ctx *fasthttp.RequestCtx) {
+		if !strings.Contains(string(ctx.Path()), "candles") {
+			ctx.SetBodyString(testSymbols)
+			return
+		}
+
+		requests++
+		// no trades from hour 100 on
+		if ctx.QueryArgs().GetUintOrZero("startAt") >= int(hours(100).Unix()) {
+			ctx.SetBodyString(`{"code":"200000","data":[]}`)
+			return
+		}
+		ctx.SetBodyString(kLinesBody(ctx))
+	})
+
+	archive, err := store.NewArchive(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+
+	route := kLinesRoute(t, kucoin.New(store.NewStore(100, store.GapSkip), archive, store.NewTTLCache(time.Minute), client, testConfig()))
+	handler := proxy.RateLimitHandler(&proxy.Config{ClientUpstreamRate: 1}, func(ctx *fasthttp.RequestCtx) {
+		if err := route(&routing.Context{RequestCtx: ctx}); err != nil {
+			t.Error(err)
+		}
+	})
+	serve := func(startAt time.Time, endAt time.Time) *fasthttp.RequestCtx {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Init(&fasthttp.Request{}, &net.TCPAddr{IP: net.ParseIP("10.0.0.1")}, nil)
+		ctx.Request.SetRequestURI(fmt.Sprintf("/kucoin/api/v1/market/candles?symbol=BTC-USDT&type=1hour&startAt=%d&endAt=%d", startAt.Unix(), endAt.Unix()))
+		handler(ctx)
+
+		return ctx
+	}
+
+	// a range without trades is fetched into the archive once and answered empty
+	if ctx := serve(hours(100), hours(110)); ctx.Response.StatusCode() != http.StatusOK || !strings.Contains(string(ctx.Response.Body()), `"data":[]`) {
+		t.Errorf("empty range: status = %d, body = %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	if requests != 1 {
+		t.Errorf("empty range: upstream requests = %d, want 1", requests)
+	}
+
+	// the budget of a single upstream request is spent
+	if ctx := serve(hours(0), hours(10)); ctx.Response.StatusCode() != http.StatusTooManyRequests {
+		t.Errorf("over budget: status = %d, want 429", ctx.Response.StatusCode())
+	}
+	if requests != 1 {
+		t.Errorf("over budget: upstream requests = %d, want 1", requests)
+	}
+}
+
+func TestKLinesServesSubscribedPollsFromCache(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+
+	now := time.Now().UTC()
+	current := now.Truncate(time.Hour)
+
+	requested := 0
+	client := upstreamClient(t, func(ctx *fasthttp.RequestCtx) {
+		if !strings.Contains(string(ctx.Path()), "candles") {
+			ctx.SetBodyString(testSymbols)
+			return
+		}
+		requested++
+		ctx.SetBodyString(kLinesBody(ctx))
+	})
+
+	// fetched at the start of the previous period, the websocket has sent every update since
+	candles := store.NewStore(100, store.GapSkip)
+	for n := 6; n >= 1; n-- {
+		candles.Store(testKey, time.Hour, &model.Candle{Ts: current.Add(-time.Duration(n) * time.Hour), Close: 1, Volume: 1})
+	}
+	candles.Verify(testKey, store.Span{From: current.Add(-6 * time.Hour), To: current.Add(-time.Hour)})
+
+	exchange := kucoin.New(candles, nil, store.NewTTLCache(time.Minute), client, testConfig())
+	exchange.Subscribed("BTC-USDT", "1hour")
+	kucoin.StoreUpdate(candles, "BTC-USDT", "1hour", &model.Candle{Ts: current.Add(-time.Hour), Close: 2, Volume: 1})
+	kucoin.StoreUpdate(candles, "BTC-USDT", "1hour", &model.Candle{Ts: current, Close: 3, Volume: 1})
+
+	ctx := getKLines(t, kLinesRoute(t, exchange), current.Add(-6*time.Hour), now)
+
+	if requested != 0 {
+		t.Errorf("requested %d pages from kucoin, want the cache to answer", requested)
+	}
+	if ts, closes := responseCandles(t, ctx.Response.Body()); len(ts) != 7 || closes[0] != "3" || closes[1] != "2" {
+		t.Errorf("candles = %v %v, want 7 with the websocket updates", ts, closes)
+	}
+}
@@ -0,0 +1,162 @@
+package kucoin
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/stash86/kucoin-proxy/model"
+	"github.com/stash86/kucoin-proxy/store"
+	"github.com/stash86/kucoin-proxy/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// kLinesPageWorkers bounds the pages of a single request fetched at once, the rate limiter paces them further.
+const kLinesPageWorkers = 4
+
+// kLinesPageError is a page kucoin failed to answer, along with its answer.
+type kLinesPageError struct {
+	statusCode int
+	data       []byte
+	err        error
+}
+
+func (e *kLinesPageError) Error() string {
+	return e.err.Error()
+}
+
+func (e *kLinesPageError) Unwrap() error {
+	return e.err
+}
+
+// kLinesPage is a page fetched from kucoin, span being what its candles cover in full and fetchedAt the time it
+// was requested at.
+type kLinesPage struct {
+	span      store.Span
+	candles   []*model.Candle
+	fetchedAt time.Time
+}
+
+// kLinesPages splits the span into spans of at most kLinesPageLimit periods, oldest first.
+func kLinesPages(span store.Span, period time.Duration) []store.Span {
+	pages := make([]store.Span, 0, 1)
+	for start := span.From; start.Before(span.To); {
+		end := start.Add(period * kLinesPageLimit)
+		if end.After(span.To) {
+			end = span.To
+		}
+
+		pages = append(pages, store.Span{From: start, To: end})
+		start = end
+	}
+
+	return pages
+}
+
+// fetchPage fetches the candles of a single page, oldest first. kucoin takes endAt as inclusive, so the page is
+// requested up to a second before its end. A full answer may have been cut short, so it only covers the page from
+// its oldest candle on. kucoin's answer to a failed page is kept in a *kLinesPageError.
+func (http *http) fetchPage(ctx context.Context, pair string, timeframe string, page store.Span) (kLinesPage, error) {
+	fetchedAt := time.Now().UTC()
+	statusCode, klinesResponse, data, err := http.getKlines(ctx, pair, timeframe, page.From.Unix(), page.To.Add(-time.Second).Unix(), 15)
+	if err != nil {
+		return kLinesPage{}, &kLinesPageError{statusCode: statusCode, data: data, err: fmt.Errorf("page '%s' '%s' [%s-%s] failed with status %d: %w", pair, timeframe, page.From, page.To, statusCode, err)}
+	}
+
+	if klinesResponse == nil {
+		return kLinesPage{}, &kLinesPageError{statusCode: statusCode, data: data, err: fmt.Errorf("page '%s' '%s' [%s-%s] has no response", pair, timeframe, page.From, page.To)}
+	}
+
+	if klinesResponse.Code != successCode {
+		return kLinesPage{}, &kLinesPageError{statusCode: statusCode, data: data, err: fmt.Errorf("page '%s' '%s' [%s-%s] failed with code '%s': %s", pair, timeframe, page.From, page.To, klinesResponse.Code, klinesResponse.Message)}
+	}
+
+	candles := make([]*model.Candle, 0, len(klinesResponse.Klines))
+	for _, c := range parseKLines(klinesResponse.Klines) {
+		if !c.Ts.Before(page.From) && c.Ts.Before(page.To) {
+			candles = append(candles, c)
+		}
+	}
+
+	sort.Slice(candles, func(i, j int) bool { return candles[i].Ts.Before(candles[j].Ts) })
+
+	if len(klinesResponse.Klines) >= kLinesPageLimit {
+		if len(candles) == 0 {
+			page.From = page.To
+		} else if candles[0].Ts.After(page.From) {
+			page.From = candles[0].Ts
+		}
+	}
+
+	return kLinesPage{span: page, candles: candles, fetchedAt: fetchedAt}, nil
+}
+
+// fetchPages splits the spans into pages and fetches them in parallel, returning the pages oldest first.
+// Pages go through getKlines, so they share its rate limiting and retries. The first failure is returned.
+func (http *http) fetchPages(ctx context.Context, pair string, timeframe string, spans []store.Span) (pages []kLinesPage, err error) {
+	period := timeframeToDuration(timeframe)
+
+	requested := make([]store.Span, 0, len(spans))
+	for _, span := range spans {
+		requested = append(requested, kLinesPages(span, period)...)
+	}
+
+	ctx, span := tracing.Start(ctx, "kucoin.fetchPages", attribute.Int("kucoin.pages", len(requested)))
+	defer func() { tracing.End(span, err) }()
+
+	pages = make([]kLinesPage, len(requested))
+
+	errs := make([]error, len(pages))
+	workers := make(chan struct{}, kLinesPageWorkers)
+	wg := sync.WaitGroup{}
+
+	for i := range requested {
+		workers <- struct{}{}
+		wg.Add(1)
+
+		go func(requested store.Span, page *kLinesPage, err *error) {
+			defer func() {
+				<-workers
+				wg.Done()
+			}()
+
+			*page, *err = http.fetchPage(ctx, pair, timeframe, requested)
+		}(requested[i], &pages[i], &errs[i])
+	}
+
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return pages, nil
+}
+
+// mergeCandles merges candles into base, both newest first, into candles newest first with unique ts. A candle
+// of candles replaces the one of base with the same ts, unless it is painted and the one of base is not.
+func mergeCandles(base []*model.Candle, candles []*model.Candle) []*model.Candle {
+	byTs := make(map[int64]*model.Candle, len(base)+len(candles))
+	for _, c := range base {
+		byTs[c.Ts.Unix()] = c
+	}
+	for _, c := range candles {
+		if previous, ok := byTs[c.Ts.Unix()]; ok && c.Synthetic && !previous.Synthetic {
+			continue
+		}
+		byTs[c.Ts.Unix()] = c
+	}
+
+	merged := make([]*model.Candle, 0, len(byTs))
+	for _, c := range byTs {
+		merged = append(merged, c)
+	}
+
+	sort.Slice(merged, func(i, j int) bool { return merged[i].Ts.After(merged[j].Ts) })
+
+	return merged
+}
@@ -0,0 +1,195 @@
+package kucoin_test
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stash86/kucoin-proxy/model"
+	"github.com/stash86/kucoin-proxy/proxy/kucoin"
+	"github.com/stash86/kucoin-proxy/store"
+	"github.com/valyala/fasthttp"
+)
+
+// cappedKLinesBody answers a candles request as kucoin does: endAt is inclusive and only the newest 1500 candles
+// of the range are returned, shifted by shift periods.
+func cappedKLinesBody(ctx *fasthttp.RequestCtx, shift int) string {
+	args := ctx.QueryArgs()
+	endAt := args.GetUintOrZero("endAt") + shift*3600
+
+	rows := make([]string, 0)
+	for ts := endAt - endAt%3600; ts >= args.GetUintOrZero("startAt") && len(rows) < 1500; ts -= 3600 {
+		rows = append(rows, fmt.Sprintf(`["%d","1","2","3","0.5","10","20"]`, ts))
+	}
+
+	return `{"code":"200000","data":[` + strings.Join(rows, ",") + `]}`
+}
+
+func TestKLinesPages(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		span store.Span
+		want []store.Span
+	}{
+		{name: "empty", span: store.Span{From: hours(0), To: hours(0)}, want: []store.Span{}},
+		{name: "single period", span: store.Span{From: hours(0), To: hours(1)}, want: []store.Span{{From: hours(0), To: hours(1)}}},
+		{name: "full page", span: store.Span{From: hours(0), To: hours(1500)}, want: []store.Span{{From: hours(0), To: hours(1500)}}},
+		{name: "a period over", span: store.Span{From: hours(0), To: hours(1501)}, want: []store.Span{{From: hours(0), To: hours(1500)}, {From: hours(1500), To: hours(1501)}}},
+		{name: "full pages", span: store.Span{From: hours(0), To: hours(3000)}, want: []store.Span{{From: hours(0), To: hours(1500)}, {From: hours(1500), To: hours(3000)}}},
+		{name: "past endAt", span: store.Span{From: hours(0), To: hours(1500).Add(time.Second)}, want: []store.Span{{From: hours(0), To: hours(1500)}, {From: hours(1500), To: hours(1500).Add(time.Second)}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := kucoin.KLinesPages(tc.span, time.Hour)
+			if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+				t.Errorf("pages = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMergeCandles(t *testing.T) {
+	painted := func(n int) *model.Candle {
+		c := candleAt(n)
+		c.Close = -1
+		c.Synthetic = true
+		return c
+	}
+	updated := func(n int) *model.Candle {
+		c := candleAt(n)
+		c.Close = 99
+		return c
+	}
+
+	for _, tc := range []struct {
+		name    string
+		base    []*model.Candle
+		candles []*model.Candle
+		want    []float64
+	}{
+		{name: "disjoint", base: []*model.Candle{candleAt(3), candleAt(1)}, candles: []*model.Candle{candleAt(2), candleAt(0)}, want: []float64{3, 2, 1, 0}},
+		{name: "unsorted", base: nil, candles: []*model.Candle{candleAt(0), candleAt(2), candleAt(1)}, want: []float64{2, 1, 0}},
+		{name: "candles win", base: []*model.Candle{candleAt(1), candleAt(0)}, candles: []*model.Candle{updated(1)}, want: []float64{99, 0}},
+		{name: "real replaces painted", base: []*model.Candle{painted(1), candleAt(0)}, candles: []*model.Candle{candleAt(1)}, want: []float64{1, 0}},
+		{name: "painted keeps real", base: []*model.Candle{candleAt(1), candleAt(0)}, candles: []*model.Candle{painted(1)}, want: []float64{1, 0}},
+		{name: "painted replaces painted", base: []*model.Candle{painted(1)}, candles: []*model.Candle{painted(1)}, want: []float64{-1}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			merged := kucoin.MergeCandles(tc.base, tc.candles)
+
+			got := make([]float64, 0, len(merged))
+			for i, c := range merged {
+				got = append(got, c.Close)
+				if i > 0 && !c.Ts.Before(merged[i-1].Ts) {
+					t.Errorf("candles are not newest first with unique ts: %v", merged)
+				}
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+				t.Errorf("closes = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestKLinesSplitsWideRanges(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+
+	l := sync.Mutex{}
+	requested := make([]string, 0)
+
+	client := upstreamClient(t, func(ctx *fasthttp.RequestCtx) {
+		if !strings.Contains(string(ctx.Path()), "candles") {
+			ctx.SetBodyString(testSymbols)
+			return
+		}
+
+		l.Lock()
+		requested = append(requested, fmt.Sprintf("%s-%s", ctx.QueryArgs().Peek("startAt"), ctx.QueryArgs().Peek("endAt")))
+		l.Unlock()
+
+		ctx.SetBodyString(cappedKLinesBody(ctx, 0))
+	})
+
+	exchange := kucoin.New(store.NewStore(100, store.GapSkip), nil, store.NewTTLCache(time.Minute), client, testConfig())
+	ctx := getKLines(t, kLinesRoute(t, exchange), hours(0), hours(3199))
+
+	ts, _ := responseCandles(t, ctx.Response.Body())
+	if len(ts) != 3200 {
+		t.Fatalf("candles = %d, want 3200", len(ts))
+	}
+	for i := range ts {
+		if want := hours(3199 - i).Unix(); ts[i] != want {
+			t.Fatalf("candle %d ts = %d, want %d", i, ts[i], want)
+		}
+	}
+
+	// endAt is inclusive, so every page ends a second before the next one starts
+	want := []string{
+		fmt.Sprintf("%d-%d", hours(0).Unix(), hours(1500).Unix()-1),
+		fmt.Sprintf("%d-%d", hours(1500).Unix(), hours(3000).Unix()-1),
+		fmt.Sprintf("%d-%d", hours(3000).Unix(), hours(3199).Unix()),
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	sort.Strings(requested)
+	if fmt.Sprint(requested) != fmt.Sprint(want) {
+		t.Errorf("requested = %v, want %v", requested, want)
+	}
+}
+
+func TestBackfillCoversFullPagesFromOldestCandle(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+
+	// the 1500 candles answered for the first page run 10 periods past it, leaving its first 10 periods out
+	client := upstreamClient(t, func(ctx *fasthttp.RequestCtx) {
+		ctx.SetBodyString(cappedKLinesBody(ctx, 10))
+	})
+
+	exchange := kucoin.New(store.NewStore(100, store.GapSkip), nil, store.NewTTLCache(time.Minute), client, testConfig())
+
+	spans := make([]store.Span, 0)
+	err := exchange.Backfill(t.Context(), "BTC-USDT", "1hour", hours(0), hours(1600), func(span store.Span, candles []*model.Candle) error {
+		spans = append(spans, span)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []store.Span{{From: hours(10), To: hours(1500)}, {From: hours(1500), To: hours(1600)}}
+	if fmt.Sprint(spans) != fmt.Sprint(want) {
+		t.Errorf("spans = %v, want %v", spans, want)
+	}
+}
+
+func TestBackfillRetriesUnparsableBodies(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+
+	requests := 0
+	client := upstreamClient(t, func(ctx *fasthttp.RequestCtx) {
+		requests++
+		if requests == 1 {
+			ctx.SetBodyString("error when reading response body: unexpected EOF")
+			return
+		}
+		ctx.SetBodyString(kLinesBody(ctx))
+	})
+
+	exchange := kucoin.New(store.NewStore(100, store.GapSkip), nil, store.NewTTLCache(time.Minute), client, testConfig())
+
+	fetched := 0
+	err := exchange.Backfill(t.Context(), "BTC-USDT", "1hour", hours(0), hours(3), func(_ store.Span, candles []*model.Candle) error {
+		fetched += len(candles)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests != 2 || fetched != 3 {
+		t.Errorf("requests = %d, candles = %d, want a retry fetching 3 candles", requests, fetched)
+	}
+}
@@ -0,0 +1,166 @@
+package kucoin
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mailru/easyjson"
+	"github.com/stash86/kucoin-proxy/proxy"
+	"github.com/stash86/kucoin-proxy/store"
+	"github.com/valyala/fasthttp"
+)
+
+// parameterErrorCode is the error kucoin answers to invalid parameters.
+const parameterErrorCode = "400100"
+
+// kLinesQuery is a validated kline request.
+type kLinesQuery struct {
+	pair      string
+	timeframe string
+	period    time.Duration
+	startAt   time.Time
+	endAt     time.Time
+}
+
+// parseKLinesQuery validates the args of a kline request, defaulting a missing endAt to now and a missing
+// startAt to a page of candles before endAt, as kucoin does.
+func parseKLinesQuery(args *fasthttp.Args, now time.Time) (kLinesQuery, error) {
+	query := kLinesQuery{
+		pair:      string(args.Peek("symbol")),
+		timeframe: string(args.Peek("type")),
+	}
+
+	if query.pair == "" {
+		return query, fmt.Errorf("symbol is required")
+	}
+
+	period, ok := timeframeDuration(query.timeframe)
+	if !ok {
+		return query, fmt.Errorf("unknown type '%s'", query.timeframe)
+	}
+	query.period = period
+
+	endAt, ok, err := parseTimestamp(args, "endAt")
+	if err != nil {
+		return query, err
+	}
+	if !ok {
+		endAt = now.Unix()
+	}
+
+	startAt, ok, err := parseTimestamp(args, "startAt")
+	if err != nil {
+		return query, err
+	}
+	if !ok {
+		startAt = endAt - int64(period/time.Second)*kLinesPageLimit
+	}
+
+	if startAt > endAt {
+		return query, fmt.Errorf("startAt %d is after endAt %d", startAt, endAt)
+	}
+
+	query.startAt = time.Unix(startAt, 0)
+	query.endAt = time.Unix(endAt, 0)
+
+	return query, nil
+}
+
+// parseTimestamp parses positive unix seconds, ok being false if the arg is missing. An explicit 0 is rejected
+// rather than taken for a missing arg, so a range never silently changes.
+func parseTimestamp(args *fasthttp.Args, name string) (ts int64, ok bool, err error) {
+	if !args.Has(name) {
+		return 0, false, nil
+	}
+
+	value := args.Peek(name)
+	ts, err = strconv.ParseInt(string(value), 10, 64)
+	if err != nil || ts <= 0 {
+		return 0, false, fmt.Errorf("%s '%s' is not a unix timestamp in seconds", name, value)
+	}
+
+	return ts, true, nil
+}
+
+// symbolSet memoizes the symbols parsed from the cached blob of the symbols route.
+type symbolSet struct {
+	l         sync.Mutex
+	container *store.Container
+	symbols   map[string]struct{}
+}
+
+// symbolsCacheKey is the key of the unfiltered symbols blob cached by the symbols route.
+func (http *http) symbolsCacheKey() string {
+	return fmt.Sprintf("/%s/%s", http.Name(), symbolsPath)
+}
+
+// knownSymbol tells whether kucoin lists the symbol, fetching and caching the symbols the way the symbols route
+// does when they are not cached.
+func (http *http) knownSymbol(ctx context.Context, symbol string) (bool, error) {
+	key := http.symbolsCacheKey()
+
+	container := http.ttlCache.Get(key)
+	if container == nil {
+		data, err := http.fetchSymbols(ctx)
+		if err != nil {
+			return false, err
+		}
+
+		http.ttlCache.Store(key, data)
+		if container = http.ttlCache.Get(key); container == nil {
+			return false, fmt.Errorf("symbols were evicted right away")
+		}
+	}
+
+	http.symbols.l.Lock()
+	defer http.symbols.l.Unlock()
+
+	if http.symbols.container != container {
+		response := &symbolsResponse{}
+		if err := easyjson.Unmarshal(container.Raw(), response); err != nil {
+			return false, fmt.Errorf("symbols response: %w", err)
+		}
+		if response.Code != successCode {
+			return false, fmt.Errorf("symbols response code '%s': %s", response.Code, response.Message)
+		}
+
+		http.symbols.symbols = make(map[string]struct{}, len(response.Symbols))
+		for _, s := range response.Symbols {
+			http.symbols.symbols[s.Symbol] = struct{}{}
+		}
+		http.symbols.container = container
+	}
+
+	_, ok := http.symbols.symbols[symbol]
+
+	return ok, nil
+}
+
+// fetchSymbols fetches the symbols blob, uncompressed like the symbols route caches it.
+func (http *http) fetchSymbols(ctx context.Context) ([]byte, error) {
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	req.SetRequestURI(fmt.Sprintf("%s/%s", http.config.KucoinApiURL, symbolsPath))
+
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+
+	http.rl.Take()
+	proxy.CountUpstream(ctx)
+	if err := http.client.DoContext(ctx, req, resp); err != nil {
+		return nil, fmt.Errorf("symbols request failed: %w", err)
+	}
+	if resp.StatusCode() != fasthttp.StatusOK {
+		return nil, fmt.Errorf("symbols request failed with status %d", resp.StatusCode())
+	}
+
+	data, err := resp.BodyUncompressed()
+	if err != nil {
+		return nil, fmt.Errorf("symbols response: %w", err)
+	}
+
+	return append([]byte(nil), data...), nil
+}
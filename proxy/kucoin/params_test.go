@@ -0,0 +1,114 @@
+package kucoin_test
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	routing "github.com/qiangxue/fasthttp-routing"
+	"github.com/sirupsen/logrus"
+	"github.com/stash86/kucoin-proxy/proxy/kucoin"
+	"github.com/stash86/kucoin-proxy/store"
+	"github.com/valyala/fasthttp"
+)
+
+func TestKLinesParameters(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+
+	candlesUpstream := func(symbols fasthttp.RequestHandler) fasthttp.RequestHandler {
+		return func(ctx *fasthttp.RequestCtx) {
+			if strings.Contains(string(ctx.Path()), "candles") {
+				ctx.SetBodyString(kLinesBody(ctx))
+				return
+			}
+			symbols(ctx)
+		}
+	}
+	listed := candlesUpstream(func(ctx *fasthttp.RequestCtx) { ctx.SetBodyString(testSymbols) })
+	unavailable := candlesUpstream(func(ctx *fasthttp.RequestCtx) { ctx.SetStatusCode(fasthttp.StatusServiceUnavailable) })
+
+	for _, tc := range []struct {
+		name     string
+		upstream fasthttp.RequestHandler
+		query    string
+		status   int
+		msg      string
+	}{
+		{name: "valid", upstream: listed, query: "symbol=BTC-USDT&type=1hour&startAt=1704067200&endAt=1704078000", status: fasthttp.StatusOK},
+		{name: "default startAt", upstream: listed, query: "symbol=BTC-USDT&type=1hour&endAt=1704078000", status: fasthttp.StatusOK},
+		{name: "missing symbol", upstream: listed, query: "type=1hour", status: fasthttp.StatusBadRequest, msg: "symbol is required"},
+		{name: "missing type", upstream: listed, query: "symbol=BTC-USDT", status: fasthttp.StatusBadRequest, msg: "unknown type ''"},
+		{name: "unknown type", upstream: listed, query: "symbol=BTC-USDT&type=3hour", status: fasthttp.StatusBadRequest, msg: "unknown type '3hour'"},
+		{name: "malformed startAt", upstream: listed, query: "symbol=BTC-USDT&type=1hour&startAt=yesterday", status: fasthttp.StatusBadRequest, msg: "startAt 'yesterday'"},
+		{name: "negative endAt", upstream: listed, query: "symbol=BTC-USDT&type=1hour&endAt=-1", status: fasthttp.StatusBadRequest, msg: "endAt '-1'"},
+		{name: "zero startAt", upstream: listed, query: "symbol=BTC-USDT&type=1hour&startAt=0&endAt=1704078000", status: fasthttp.StatusBadRequest, msg: "startAt '0'"},
+		{name: "zero endAt", upstream: listed, query: "symbol=BTC-USDT&type=1hour&startAt=1704067200&endAt=0", status: fasthttp.StatusBadRequest, msg: "endAt '0'"},
+		{name: "reversed range", upstream: listed, query: "symbol=BTC-USDT&type=1hour&startAt=1704078000&endAt=1704067200", status: fasthttp.StatusBadRequest, msg: "is after endAt"},
+		{name: "unknown symbol", upstream: listed, query: "symbol=XRP-USDT&type=1hour&startAt=1704067200&endAt=1704078000", status: fasthttp.StatusBadRequest, msg: "unknown symbol 'XRP-USDT'"},
+		{name: "symbols unavailable", upstream: unavailable, query: "symbol=XRP-USDT&type=1hour&startAt=1704067200&endAt=1704078000", status: fasthttp.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client := upstreamClient(t, tc.upstream)
+			handler := kLinesRoute(t, kucoin.New(store.NewStore(100, store.GapSkip), nil, store.NewTTLCache(time.Minute), client, testConfig()))
+
+			ctx := &fasthttp.RequestCtx{}
+			ctx.Request.SetRequestURI("/kucoin/api/v1/market/candles?" + tc.query)
+			if err := handler(&routing.Context{RequestCtx: ctx}); err != nil {
+				t.Fatal(err)
+			}
+
+			body := string(ctx.Response.Body())
+			if ctx.Response.StatusCode() != tc.status {
+				t.Fatalf("status = %d, want %d: %s", ctx.Response.StatusCode(), tc.status, body)
+			}
+			if tc.status == fasthttp.StatusBadRequest && (!strings.Contains(body, `"code":"400100"`) || !strings.Contains(body, tc.msg)) {
+				t.Errorf("body = %s, want code 400100 and %q", body, tc.msg)
+			}
+			if tc.status == fasthttp.StatusOK && !strings.Contains(body, `"code":"200000"`) {
+				t.Errorf("body = %s, want candles", body)
+			}
+		})
+	}
+}
+
+func TestKLinesUncheckedSymbolIsNotKept(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+
+	client := upstreamClient(t, func(ctx *fasthttp.RequestCtx) {
+		if strings.Contains(string(ctx.Path()), "candles") {
+			ctx.SetBodyString(kLinesBody(ctx))
+			return
+		}
+		ctx.SetStatusCode(fasthttp.StatusServiceUnavailable)
+	})
+
+	dir := t.TempDir()
+	archive, err := store.NewArchive(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close() //nolint:errcheck
+
+	candles := store.NewStore(100, store.GapSkip)
+	handler := kLinesRoute(t, kucoin.New(candles, archive, store.NewTTLCache(time.Minute), client, testConfig()))
+
+	// a range of closed candles would be archived, one reaching now cached and subscribed
+	for _, query := range []string{"startAt=1704067200&endAt=1704078000", ""} {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.SetRequestURI("/kucoin/api/v1/market/candles?symbol=XRP-USDT&type=1hour&" + query)
+		if err := handler(&routing.Context{RequestCtx: ctx}); err != nil {
+			t.Fatal(err)
+		}
+		if ctx.Response.StatusCode() != fasthttp.StatusOK {
+			t.Fatalf("status = %d, want candles from kucoin: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+		}
+	}
+
+	if buckets := candles.Buckets(); len(buckets) != 0 {
+		t.Errorf("buckets = %+v, want none for an unchecked symbol", buckets)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("archive files = %v, want none for an unchecked symbol", entries)
+	}
+}
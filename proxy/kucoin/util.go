@@ -4,50 +4,66 @@ import (
 	"bytes"
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/spf13/cast"
 	"github.com/stash86/kucoin-proxy/model"
 )
 
+const storeKeyPrefix = "kucoin-"
+
 var (
 	startArrayJsonBytes = []byte(`[`)
 	endArrayJsonBytes   = []byte(`]`)
 )
 
+var timeframes = map[string]time.Duration{
+	"1min":   time.Minute,
+	"3min":   time.Minute * 3,
+	"5min":   time.Minute * 5,
+	"15min":  time.Minute * 15,
+	"30min":  time.Minute * 30,
+	"1hour":  time.Hour,
+	"2hour":  time.Hour * 2,
+	"4hour":  time.Hour * 4,
+	"6hour":  time.Hour * 6,
+	"8hour":  time.Hour * 8,
+	"12hour": time.Hour * 12,
+	"1day":   time.Hour * 24,
+	"1week":  time.Hour * 24 * 7,
+}
+
+func timeframeDuration(timeframe string) (time.Duration, bool) {
+	d, ok := timeframes[timeframe]
+	return d, ok
+}
+
 func timeframeToDuration(timeframe string) time.Duration {
-	switch timeframe {
-	case "1min":
-		return time.Minute
-	case "3min":
-		return time.Minute * 3
-	case "5min":
-		return time.Minute * 5
-	case "15min":
-		return time.Minute * 15
-	case "30min":
-		return time.Minute * 30
-	case "1hour":
-		return time.Hour
-	case "2hour":
-		return time.Hour * 2
-	case "4hour":
-		return time.Hour * 4
-	case "6hour":
-		return time.Hour * 6
-	case "8hour":
-		return time.Hour * 8
-	case "12hour":
-		return time.Hour * 12
-	case "1day":
-		return time.Hour * 24
+	if d, ok := timeframeDuration(timeframe); ok {
+		return d
 	}
 
 	return time.Hour * 24 * 7
 }
 
 func storeKey(pair string, tf string) string {
-	return fmt.Sprintf("kucoin-%s-%s", pair, tf)
+	return fmt.Sprintf("%s%s-%s", storeKeyPrefix, pair, tf)
+}
+
+// parseStoreKey splits a key built by storeKey back into pair and timeframe.
+func parseStoreKey(key string) (string, string, bool) {
+	pairTf, ok := strings.CutPrefix(key, storeKeyPrefix)
+	if !ok {
+		return "", "", false
+	}
+
+	i := strings.LastIndex(pairTf, "-")
+	if i <= 0 {
+		return "", "", false
+	}
+
+	return pairTf[:i], pairTf[i+1:], true
 }
 
 func parseCandle(candle kLine) *model.Candle {
@@ -96,3 +112,10 @@ func candlesJSON(candles []*model.Candle) []byte {
 func wsTopic(pair string, tf string) string {
 	return fmt.Sprintf("%s_%s", pair, tf)
 }
+
+// topicStoreKey returns the store key of a topic built by wsTopic.
+func topicStoreKey(topic string) string {
+	pair, tf, _ := strings.Cut(topic, "_")
+
+	return storeKey(pair, tf)
+}
@@ -0,0 +1,117 @@
+package kucoin
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mailru/easyjson"
+	"github.com/sirupsen/logrus"
+	"github.com/stash86/kucoin-proxy/store"
+)
+
+const warmupWildcard = "*-"
+
+// WarmUp prefetches cache-size candles and subscribes to updates for every configured warm-up pair
+// and timeframe. Prefetching goes through getKlines and subscribing through the subscriber, so both are
+// paced by the shared rate limiters.
+func (http *http) WarmUp() error {
+	if len(http.config.KucoinWarmupTimeframes) == 0 {
+		return nil
+	}
+
+	pairs, err := http.warmupPairs()
+	if err != nil {
+		return err
+	}
+
+	total := len(pairs) * len(http.config.KucoinWarmupTimeframes)
+	logrus.Infof("warm-up: prefetching %d pairs on %d timeframes", len(pairs), len(http.config.KucoinWarmupTimeframes))
+
+	start := time.Now()
+	done := 0
+	for _, pair := range pairs {
+		for _, timeframe := range http.config.KucoinWarmupTimeframes {
+			done++
+
+			if err := http.prefetch(context.Background(), pair, timeframe); err != nil {
+				logrus.Warnf("warm-up %d/%d: %s %s failed: %v", done, total, pair, timeframe, err)
+				continue
+			}
+
+			http.subscriber.subscribeKLines(pair, timeframe)
+
+			logrus.Infof("warm-up %d/%d: %s %s done", done, total, pair, timeframe)
+		}
+	}
+
+	logrus.Infof("warm-up: %d keys done in %s", total, time.Since(start))
+
+	return nil
+}
+
+func (http *http) prefetch(ctx context.Context, pair string, timeframe string) error {
+	period := timeframeToDuration(timeframe)
+
+	size := http.store.CacheSize()
+	if size > kLinesPageLimit {
+		size = kLinesPageLimit
+	}
+
+	endAt := time.Now().UTC()
+	startAt := endAt.Add(-period * time.Duration(size))
+
+	page, err := http.fetchPage(ctx, pair, timeframe, store.Span{From: startAt, To: endAt})
+	if err != nil {
+		return err
+	}
+
+	http.store.Store(storeKey(pair, timeframe), period, page.candles...)
+	http.store.Verify(storeKey(pair, timeframe), page.span)
+
+	if http.archive != nil {
+		http.archiveClosed(pair, timeframe, page)
+	}
+
+	return nil
+}
+
+// warmupPairs expands wildcards like '*-USDT' into all trading pairs of the quote currency.
+func (http *http) warmupPairs() ([]string, error) {
+	pairs := make([]string, 0, len(http.config.KucoinWarmupPairs))
+	quotes := map[string]struct{}{}
+
+	for _, pair := range http.config.KucoinWarmupPairs {
+		if strings.HasPrefix(pair, warmupWildcard) {
+			quotes[strings.TrimPrefix(pair, warmupWildcard)] = struct{}{}
+			continue
+		}
+		pairs = append(pairs, pair)
+	}
+
+	if len(quotes) == 0 {
+		return pairs, nil
+	}
+
+	data, err := http.fetchSymbols(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("warm-up %w", err)
+	}
+
+	symbols := &symbolsResponse{}
+	if err := easyjson.Unmarshal(data, symbols); err != nil {
+		return nil, fmt.Errorf("warm-up symbols response: %w", err)
+	}
+	if symbols.Code != successCode {
+		return nil, fmt.Errorf("warm-up symbols response code '%s': %s", symbols.Code, symbols.Message)
+	}
+
+	for _, symbol := range symbols.Symbols {
+		if _, ok := quotes[symbol.QuoteCurrency]; ok && symbol.EnableTrading {
+			pairs = append(pairs, symbol.Symbol)
+		}
+	}
+
+	return pairs, nil
+}
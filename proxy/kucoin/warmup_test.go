@@ -0,0 +1,104 @@
+package kucoin_test
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stash86/kucoin-proxy/proxy"
+	"github.com/stash86/kucoin-proxy/proxy/kucoin"
+	"github.com/stash86/kucoin-proxy/store"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+const testSymbols = `{"code":"200000","data":[` +
+	`{"symbol":"BTC-USDT","baseCurrency":"BTC","quoteCurrency":"USDT","enableTrading":true},` +
+	`{"symbol":"OLD-USDT","baseCurrency":"OLD","quoteCurrency":"USDT","enableTrading":false},` +
+	`{"symbol":"ETH-BTC","baseCurrency":"ETH","quoteCurrency":"BTC","enableTrading":true}]}`
+
+// upstreamClient returns a client of an in-memory upstream served by handler.
+func upstreamClient(t *testing.T, handler fasthttp.RequestHandler) *proxy.Client {
+	t.Helper()
+
+	ln := fasthttputil.NewInmemoryListener()
+	t.Cleanup(func() { ln.Close() })
+	go fasthttp.Serve(ln, handler) //nolint:errcheck
+
+	return &proxy.Client{Client: fasthttp.Client{Dial: func(string) (net.Conn, error) { return ln.Dial() }}}
+}
+
+func testConfig() *kucoin.Config {
+	return &kucoin.Config{KucoinApiURL: "http://upstream", KucoinTopicsPerWs: 10, KucoinFormingCandle: kucoin.FormingInclude}
+}
+
+func TestWarmupPairs(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+
+	calls := 0
+	client := upstreamClient(t, func(ctx *fasthttp.RequestCtx) {
+		calls++
+		ctx.SetBodyString(testSymbols)
+	})
+
+	for _, tc := range []struct {
+		name  string
+		pairs []string
+		want  []string
+		calls int
+	}{
+		{name: "explicit", pairs: []string{"ETH-BTC", "XRP-USDT"}, want: []string{"ETH-BTC", "XRP-USDT"}},
+		{name: "wildcard", pairs: []string{"XRP-USDT", "*-USDT"}, want: []string{"XRP-USDT", "BTC-USDT"}, calls: 1},
+		{name: "wildcards", pairs: []string{"*-USDT", "*-BTC"}, want: []string{"BTC-USDT", "ETH-BTC"}, calls: 1},
+		{name: "unknown quote", pairs: []string{"*-EUR"}, want: []string{}, calls: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			calls = 0
+			config := testConfig()
+			config.KucoinWarmupPairs = tc.pairs
+
+			pairs, err := kucoin.WarmupPairs(kucoin.New(store.NewStore(10, store.GapSkip), nil, store.NewTTLCache(time.Minute), client, config))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(pairs, tc.want) {
+				t.Errorf("pairs = %v, want %v", pairs, tc.want)
+			}
+			if calls != tc.calls {
+				t.Errorf("symbols requests = %d, want %d", calls, tc.calls)
+			}
+		})
+	}
+}
+
+func TestWarmUpFailsWithoutSymbols(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+
+	for _, tc := range []struct {
+		name    string
+		handler fasthttp.RequestHandler
+	}{
+		{name: "status", handler: func(ctx *fasthttp.RequestCtx) { ctx.SetStatusCode(fasthttp.StatusBadGateway) }},
+		{name: "body", handler: func(ctx *fasthttp.RequestCtx) { ctx.SetBodyString("<html>") }},
+		{name: "code", handler: func(ctx *fasthttp.RequestCtx) { ctx.SetBodyString(`{"code":"429000","msg":"too many requests"}`) }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config := testConfig()
+			config.KucoinWarmupPairs = []string{"*-USDT"}
+			config.KucoinWarmupTimeframes = []string{"1hour"}
+
+			candles := store.NewStore(10, store.GapSkip)
+			exchange := kucoin.New(candles, nil, store.NewTTLCache(time.Minute), upstreamClient(t, tc.handler), config)
+
+			// main aborts the startup on this error
+			if err := exchange.WarmUp(); err == nil {
+				t.Fatal("warm-up succeeded without symbols")
+			}
+			if len(candles.Buckets()) != 0 {
+				t.Errorf("buckets = %v, want none", candles.Buckets())
+			}
+		})
+	}
+}
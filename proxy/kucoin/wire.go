@@ -78,3 +78,15 @@ type kLine [7]string
 
 //easyjson:json
 type kLines []*kLine
+
+//easyjson:json
+type symbolsResponse struct {
+	Code    string `json:"code"`
+	Symbols []struct {
+		Symbol        string `json:"symbol"`
+		BaseCurrency  string `json:"baseCurrency"`
+		QuoteCurrency string `json:"quoteCurrency"`
+		EnableTrading bool   `json:"enableTrading"`
+	} `json:"data"`
+	Message string `json:"message"`
+}
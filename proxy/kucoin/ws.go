@@ -1,15 +1,20 @@
 package kucoin
 
 import (
+	"context"
 	"fmt"
+	"runtime/pprof"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dgrr/websocket"
 	"github.com/google/uuid"
 	"github.com/mailru/easyjson"
 	"github.com/sirupsen/logrus"
+	"github.com/stash86/kucoin-proxy/model"
 	"github.com/stash86/kucoin-proxy/proxy"
 	"github.com/stash86/kucoin-proxy/store"
 	"go.uber.org/ratelimit"
@@ -18,9 +23,10 @@ import (
 const (
 	bulletPublicPath = "/api/v1/bullet-public"
 
-	welcomeMessageType   = "welcome"
-	messageMessageType   = "message"
-	subscribeMessageType = "subscribe"
+	welcomeMessageType     = "welcome"
+	messageMessageType     = "message"
+	subscribeMessageType   = "subscribe"
+	unsubscribeMessageType = "unsubscribe"
 
 	ping = "ping"
 	pong = "pong"
@@ -28,12 +34,18 @@ const (
 	marketCandlesTopicPrefix = "/market/candles:"
 )
 
+// subscription is a topic served by a ws connection.
+type subscription struct {
+	conn       *ws
+	lastUpdate atomic.Int64
+}
+
 type subscriber struct {
 	pool []*ws
 
 	wsRl   ratelimit.Limiter
 	l      *sync.Mutex
-	subs   map[string]struct{}
+	subs   map[string]*subscription
 	client *proxy.Client
 	config *Config
 	store  *store.Store
@@ -49,7 +61,8 @@ func (s *subscriber) subscribeKLines(pair string, tf string) {
 		return
 	}
 
-	s.subs[topic] = struct{}{}
+	// updates of a previous subscription may have been missed since
+	s.store.DropExtended(storeKey(pair, tf))
 
 	for i, c := range s.pool {
 		if c.subsCount == s.config.KucoinTopicsPerWs {
@@ -57,6 +70,7 @@ func (s *subscriber) subscribeKLines(pair string, tf string) {
 		}
 
 		c.subsCount += 1
+		s.subs[topic] = c.track(topic)
 		s.wsRl.Take()
 		if err := c.subscribeKLines(topic); err != nil {
 			logrus.Fatal(err)
@@ -78,14 +92,17 @@ func (s *subscriber) subscribeKLines(pair string, tf string) {
 		id:         uuid.New(),
 		conn:       nil,
 		pingPongCh: make(chan uuid.UUID, 1),
+		topics:     map[string]*subscription{},
+		topicsLock: new(sync.RWMutex),
 
 		writeLock: new(sync.Mutex),
 	}
 
 	wsConn.connect()
-	go wsConn.serve()
+	go wsConn.labeled("reader", wsConn.serve)
 
 	wsConn.subsCount += 1
+	s.subs[topic] = wsConn.track(topic)
 	if err := wsConn.subscribeKLines(topic); err != nil {
 		logrus.Fatal(err)
 	}
@@ -94,6 +111,29 @@ func (s *subscriber) subscribeKLines(pair string, tf string) {
 	logrus.Infof("#%d-%d topic: '%s' subscribing...", len(s.pool), 1, topic)
 }
 
+// unsubscribeKLines drops the topic of the pair, freeing its place on the ws connection.
+func (s *subscriber) unsubscribeKLines(pair string, tf string) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	topic := wsTopic(pair, tf)
+	sub, ok := s.subs[topic]
+	if !ok {
+		return
+	}
+
+	delete(s.subs, topic)
+	sub.conn.subsCount -= 1
+	sub.conn.untrack(topic)
+
+	s.wsRl.Take()
+	if err := sub.conn.writeTopicMessage(unsubscribeMessageType, topic); err != nil {
+		logrus.Fatal(err)
+	}
+
+	logrus.Infof("topic: '%s' unsubscribing...", topic)
+}
+
 type ws struct {
 	id uuid.UUID
 
@@ -105,16 +145,51 @@ type ws struct {
 	store      *store.Store
 	config     *Config
 
-	conn *websocket.Client
+	conn proxy.WSConn
 	wsRl ratelimit.Limiter
 
 	pingInterval *time.Ticker
 	pingTimeout  time.Duration
 	pingPongCh   chan uuid.UUID
 
+	topics     map[string]*subscription
+	topicsLock *sync.RWMutex
+
 	writeLock *sync.Mutex
 }
 
+func (w *ws) track(topic string) *subscription {
+	w.topicsLock.Lock()
+	defer w.topicsLock.Unlock()
+
+	sub := &subscription{conn: w}
+	w.topics[topic] = sub
+
+	return sub
+}
+
+func (w *ws) untrack(topic string) {
+	w.topicsLock.Lock()
+	defer w.topicsLock.Unlock()
+
+	delete(w.topics, topic)
+}
+
+// touch marks an update of the topic, reporting whether it is still tracked.
+func (w *ws) touch(topic string) bool {
+	w.topicsLock.RLock()
+	sub := w.topics[topic]
+	w.topicsLock.RUnlock()
+
+	if sub == nil {
+		return false
+	}
+
+	sub.lastUpdate.Store(time.Now().UnixNano())
+
+	return true
+}
+
 func (w *ws) executeBulletPublicRequest() (int, *bulletPublicResponse, error) {
 	w.httpRl.Take()
 
@@ -161,7 +236,7 @@ func (w *ws) connect() {
 
 	path := fmt.Sprintf("%s?token=%s&connectId=%s", bulletResp.Data.InstanceServers[0].Endpoint, bulletResp.Data.Token, w.id.String())
 
-	conn, err := websocket.Dial(path)
+	conn, err := w.client.DialWS(path)
 	if err != nil {
 		logrus.Fatal(err)
 	}
@@ -169,7 +244,14 @@ func (w *ws) connect() {
 	w.conn = conn
 
 	w.readWelcomeMsg()
-	go w.pingPongRoutine()
+	go w.labeled("pinger", w.pingPongRoutine)
+}
+
+// labeled runs fn with pprof labels of the connection, telling its goroutines apart in goroutine profiles.
+func (w *ws) labeled(role string, fn func()) {
+	pprof.Do(context.Background(), pprof.Labels("ws", w.id.String(), "role", role), func(context.Context) {
+		fn()
+	})
 }
 
 func (w *ws) handlePongResponse(waitForID uuid.UUID) {
@@ -244,13 +326,17 @@ func (w *ws) readWelcomeMsg() {
 }
 
 func (w *ws) subscribeKLines(topic string) error {
+	return w.writeTopicMessage(subscribeMessageType, topic)
+}
+
+func (w *ws) writeTopicMessage(messageType string, topic string) error {
 	topic = fmt.Sprintf("%s%s", marketCandlesTopicPrefix, topic)
 
-	logrus.Debugf("subscribing to '%s'...", topic)
+	logrus.Debugf("%s to '%s'...", messageType, topic)
 
 	message := subscribeMessageRequest{
 		ID:             uuid.New(),
-		Type:           subscribeMessageType,
+		Type:           messageType,
 		Topic:          topic,
 		PrivateChannel: false,
 		Response:       false,
@@ -289,6 +375,12 @@ func (w *ws) processFrame(frame *websocket.Frame) {
 	case messageMessageType:
 		if strings.HasPrefix(message.Topic, marketCandlesTopicPrefix) {
 			pairTf := message.Topic[len(marketCandlesTopicPrefix):]
+
+			// updates in flight of an unsubscribed topic would bring its evicted bucket back
+			if !w.touch(pairTf) {
+				return
+			}
+
 			pair := strings.Split(pairTf, "_")[0]
 			tf := strings.Split(pairTf, "_")[1]
 
@@ -297,13 +389,23 @@ func (w *ws) processFrame(frame *websocket.Frame) {
 				logrus.Fatal(err)
 			}
 
-			w.store.Store(storeKey(pair, tf), timeframeToDuration(tf), parseCandle(entry.Candles))
+			storeUpdate(w.store, pair, tf, parseCandle(entry.Candles))
 
 			return
 		}
 	}
 }
 
+// storeUpdate stores a candle of a subscribed topic, its period continuing what the bucket has verified as long as
+// the updates come in without holes.
+func storeUpdate(s *store.Store, pair string, tf string, candle *model.Candle) {
+	key := storeKey(pair, tf)
+	period := timeframeToDuration(tf)
+
+	s.Store(key, period, candle)
+	s.Extend(key, period, candle.Ts)
+}
+
 func (w *ws) serve() {
 	for {
 		frame := websocket.AcquireFrame()
@@ -317,3 +419,51 @@ func (w *ws) serve() {
 		websocket.ReleaseFrame(frame)
 	}
 }
+
+// SubscriptionStats describes a subscribed topic and the ws connection serving it.
+type SubscriptionStats struct {
+	Topic      string    `json:"topic"`
+	Conn       string    `json:"conn"`
+	LastUpdate time.Time `json:"lastUpdate"`
+}
+
+func (s *subscriber) stats() []SubscriptionStats {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	stats := make([]SubscriptionStats, 0, len(s.subs))
+	for topic, sub := range s.subs {
+		stat := SubscriptionStats{Topic: topic, Conn: sub.conn.id.String()}
+		if ts := sub.lastUpdate.Load(); ts > 0 {
+			stat.LastUpdate = time.Unix(0, ts).UTC()
+		}
+		stats = append(stats, stat)
+	}
+
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Topic < stats[j].Topic })
+
+	return stats
+}
+
+// resubscribe repeats the subscription of the topic on its ws connection, reporting whether it was subscribed.
+func (s *subscriber) resubscribe(topic string) bool {
+	s.l.Lock()
+	sub := s.subs[topic]
+	s.l.Unlock()
+
+	if sub == nil {
+		return false
+	}
+
+	// updates may have been missed until the topic is subscribed again
+	s.store.DropExtended(topicStoreKey(topic))
+
+	s.wsRl.Take()
+	if err := sub.conn.subscribeKLines(topic); err != nil {
+		logrus.Fatal(err)
+	}
+
+	logrus.Infof("topic: '%s' resubscribing...", topic)
+
+	return true
+}
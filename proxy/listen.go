@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	unixScheme = "unix://"
+
+	defaultSocketMode = 0o660
+)
+
+// parseSocketMode parses octal permissions like 0660.
+func parseSocketMode(mode string) (os.FileMode, error) {
+	if mode == "" {
+		return defaultSocketMode, nil
+	}
+
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || perm > 0o777 {
+		return 0, fmt.Errorf("wrong socket mode '%s'", mode)
+	}
+
+	return os.FileMode(perm), nil
+}
+
+// validateListenAddress accepts host:port with an IPv4 or IPv6 host, or unix:///path.
+func validateListenAddress(address string) error {
+	if path, ok := strings.CutPrefix(address, unixScheme); ok {
+		if path == "" {
+			return fmt.Errorf("unix socket address '%s' has no path", address)
+		}
+		return nil
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	if host != "" && net.ParseIP(host) == nil {
+		return fmt.Errorf("listen address '%s' must have an ip host", address)
+	}
+
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("listen address '%s' has a wrong port", address)
+	}
+
+	return nil
+}
+
+// validateDebugAddress accepts a unix socket or a loopback host:port, the debug listener sending the admin
+// credentials without tls.
+func validateDebugAddress(address string) error {
+	if err := validateListenAddress(address); err != nil {
+		return err
+	}
+
+	if strings.HasPrefix(address, unixScheme) {
+		return nil
+	}
+
+	host, _, _ := net.SplitHostPort(address)
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("debug address '%s' must be a loopback host or a unix socket", address)
+	}
+
+	return nil
+}
+
+// listen opens a tcp listener of host:port or a unix socket of unix:///path with the mode, replacing a stale
+// socket file left by a previous run.
+func listen(address string, socketMode os.FileMode) (net.Listener, error) {
+	path, ok := strings.CutPrefix(address, unixScheme)
+	if !ok {
+		return net.Listen(tcpNetwork(address), address)
+	}
+
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("'%s' exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(path, socketMode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	return ln, nil
+}
+
+// tcpNetwork keeps IPv4 hosts on IPv4 only, as before IPv6 was supported.
+func tcpNetwork(address string) string {
+	host, _, _ := net.SplitHostPort(address)
+
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return "tcp"
+	case ip.To4() != nil:
+		return "tcp4"
+	}
+
+	return "tcp6"
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	anyMethod = "*"
+
+	// forbiddenCode is the exchange's code of requests lacking permissions
+	forbiddenCode = "400007"
+)
+
+// PassthroughRule matches requests by method, * for any, and path, a trailing * matching any suffix.
+type PassthroughRule struct {
+	Method string
+	Path   string
+}
+
+// ParsePassthroughRules parses "METHOD /path" rules, e.g. "GET /api/v1/market/*" or "* /api/v1/orders*".
+func ParsePassthroughRules(rules []string) ([]PassthroughRule, error) {
+	parsed := make([]PassthroughRule, 0, len(rules))
+
+	for _, rule := range rules {
+		method, path, ok := strings.Cut(strings.TrimSpace(rule), " ")
+		path = strings.TrimSpace(path)
+		if !ok || method == "" || !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("passthrough rule '%s' is not 'METHOD /path'", rule)
+		}
+
+		parsed = append(parsed, PassthroughRule{Method: strings.ToUpper(method), Path: path})
+	}
+
+	return parsed, nil
+}
+
+func (r PassthroughRule) matches(method string, path string) bool {
+	if r.Method != anyMethod && r.Method != method {
+		return false
+	}
+
+	if prefix, ok := strings.CutSuffix(r.Path, "*"); ok {
+		return strings.HasPrefix(path, prefix)
+	}
+
+	return r.Path == path
+}
+
+// passthroughFilter allows requests matching no deny rule and, when there are allow rules, one of them.
+type passthroughFilter struct {
+	allow []PassthroughRule
+	deny  []PassthroughRule
+}
+
+func (f *passthroughFilter) allowed(method string, path string) bool {
+	for _, rule := range f.deny {
+		if rule.matches(method, path) {
+			return false
+		}
+	}
+
+	if len(f.allow) == 0 {
+		return true
+	}
+
+	for _, rule := range f.allow {
+		if rule.matches(method, path) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// PassthroughOption tunes TransparentHandler.
+type PassthroughOption func(filter *passthroughFilter)
+
+// WithPassthroughRules restricts the forwarded requests to the allow rules, if any, minus the deny rules.
+func WithPassthroughRules(allow []PassthroughRule, deny []PassthroughRule) PassthroughOption {
+	return func(filter *passthroughFilter) {
+		filter.allow = allow
+		filter.deny = deny
+	}
+}
+
+func rejectPassthrough(ctx *fasthttp.RequestCtx, method string, path string) {
+	logrus.Warnf("client '%s' is not allowed to pass %s %s through", ClientName(ctx), method, path)
+	WriteError(ctx, http.StatusForbidden, forbiddenCode, fmt.Sprintf("%s %s is not allowed by the proxy", method, path))
+}
@@ -0,0 +1,65 @@
+package proxy_test
+
+import (
+	"net"
+	"testing"
+
+	routing "github.com/qiangxue/fasthttp-routing"
+	"github.com/sirupsen/logrus"
+	"github.com/stash86/kucoin-proxy/proxy"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+func TestTransparentHandlerRules(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+
+	go fasthttp.Serve(ln, func(ctx *fasthttp.RequestCtx) { //nolint:errcheck
+		ctx.SetBodyString(`{"code":"200000"}`)
+	})
+
+	allow, err := proxy.ParsePassthroughRules([]string{"GET /api/v1/market/*", "GET /api/v1/timestamp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deny, err := proxy.ParsePassthroughRules([]string{"* /api/v1/market/orderbook/level3*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := proxy.TransparentHandler(
+		func(c *routing.Context) string { return "http://upstream" + string(c.Path()) },
+		&proxy.Client{Client: fasthttp.Client{Dial: func(string) (net.Conn, error) { return ln.Dial() }}},
+		proxy.WithPassthroughRules(allow, deny),
+	)
+
+	for _, tc := range []struct {
+		method string
+		path   string
+		want   int
+	}{
+		{method: "GET", path: "/api/v1/market/stats", want: fasthttp.StatusOK},
+		{method: "GET", path: "/api/v1/timestamp", want: fasthttp.StatusOK},
+		{method: "POST", path: "/api/v1/market/stats", want: fasthttp.StatusForbidden},
+		{method: "GET", path: "/api/v1/market/orderbook/level3", want: fasthttp.StatusForbidden},
+		{method: "POST", path: "/api/v1/orders", want: fasthttp.StatusForbidden},
+	} {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.Header.SetMethod(tc.method)
+		ctx.Request.SetRequestURI(tc.path)
+
+		if err := handler(&routing.Context{RequestCtx: ctx}); err != nil {
+			t.Fatal(err)
+		}
+		if got := ctx.Response.StatusCode(); got != tc.want {
+			t.Errorf("%s %s status = %d, want %d", tc.method, tc.path, got, tc.want)
+		}
+	}
+
+	if _, err := proxy.ParsePassthroughRules([]string{"GET api/v1"}); err == nil {
+		t.Error("a rule without a leading slash was parsed")
+	}
+}
@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stash86/kucoin-proxy/metrics"
+	"github.com/valyala/fasthttp"
+	"golang.org/x/time/rate"
+)
+
+const (
+	limiterUserValue = "limiter"
+
+	tooManyRequestsCode = "429000"
+
+	cacheBudget    = "cache"
+	upstreamBudget = "upstream"
+
+	// limiterIdleTimeout is how long the limiters of a client are kept unused before they may be dropped
+	limiterIdleTimeout = 10 * time.Minute
+)
+
+// clientRates are the requests per second of a client, 0 meaning unlimited.
+type clientRates struct {
+	cache    float64
+	upstream float64
+}
+
+type clientLimiter struct {
+	client   string
+	cache    *rate.Limiter
+	upstream *rate.Limiter
+	// used is the time of the last request of the client, guarded by the lock of the limiters
+	used time.Time
+}
+
+// idle tells whether the client made no request for limiterIdleTimeout and its budgets refilled since, so
+// dropping its limiters loses nothing.
+func (l *clientLimiter) idle(now time.Time) bool {
+	return now.Sub(l.used) > limiterIdleTimeout && refilled(l.cache, now) && refilled(l.upstream, now)
+}
+
+func refilled(limiter *rate.Limiter, now time.Time) bool {
+	return limiter.Limit() == rate.Inf || limiter.TokensAt(now) >= float64(limiter.Burst())
+}
+
+func newLimiter(rps float64) *rate.Limiter {
+	if rps <= 0 {
+		return rate.NewLimiter(rate.Inf, 0)
+	}
+
+	return rate.NewLimiter(rate.Limit(rps), int(math.Ceil(rps)))
+}
+
+// parseClientLimits parses name:rate:upstream-rate entries, the rates being split from the right so that the name
+// may be an IPv6 address.
+func parseClientLimits(entries []string) (map[string]clientRates, error) {
+	limits := make(map[string]clientRates, len(entries))
+
+	for _, entry := range entries {
+		upstreamAt := strings.LastIndex(entry, ":")
+		cacheAt := -1
+		if upstreamAt > 0 {
+			cacheAt = strings.LastIndex(entry[:upstreamAt], ":")
+		}
+		if cacheAt <= 0 {
+			return nil, fmt.Errorf("client limit '%s' is not name:rate:upstream-rate", entry)
+		}
+		parts := []string{entry[:cacheAt], entry[cacheAt+1 : upstreamAt], entry[upstreamAt+1:]}
+
+		cache, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("client limit '%s': %w", entry, err)
+		}
+
+		upstream, err := strconv.ParseFloat(parts[2], 64)
+		if err != nil {
+			return nil, fmt.Errorf("client limit '%s': %w", entry, err)
+		}
+
+		limits[parts[0]] = clientRates{cache: cache, upstream: upstream}
+	}
+
+	return limits, nil
+}
+
+// RateLimitHandler limits the requests of every client, identified by its name or else its ip. Every request
+// takes from the cache budget, TakeUpstream additionally takes from the upstream budget.
+func RateLimitHandler(config *Config, h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	limits, err := parseClientLimits(config.ClientLimits)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	defaults := clientRates{cache: config.ClientRate, upstream: config.ClientUpstreamRate}
+	if defaults.cache <= 0 && defaults.upstream <= 0 && len(limits) == 0 {
+		return h
+	}
+
+	l := new(sync.Mutex)
+	limiters := map[string]*clientLimiter{}
+	swept := time.Now()
+
+	return func(ctx *fasthttp.RequestCtx) {
+		if config.AdminPassword != "" && isAdminPath(ctx.Path()) {
+			h(ctx)
+			return
+		}
+
+		client := ClientName(ctx)
+		if client == "" || client == anonymousClient {
+			client = ctx.RemoteIP().String()
+		}
+
+		now := time.Now()
+
+		l.Lock()
+		// clients come and go, especially the anonymous ones identified by their ip
+		if now.Sub(swept) > limiterIdleTimeout {
+			for name, limiter := range limiters {
+				if limiter.idle(now) {
+					delete(limiters, name)
+				}
+			}
+			swept = now
+		}
+
+		limiter, ok := limiters[client]
+		if !ok {
+			rates, ok := limits[client]
+			if !ok {
+				rates = defaults
+			}
+			limiter = &clientLimiter{client: client, cache: newLimiter(rates.cache), upstream: newLimiter(rates.upstream)}
+			limiters[client] = limiter
+		}
+		limiter.used = now
+		l.Unlock()
+
+		if !limiter.cache.Allow() {
+			rejectRateLimited(ctx, client, cacheBudget)
+			return
+		}
+
+		ctx.SetUserValue(limiterUserValue, limiter)
+
+		h(ctx)
+	}
+}
+
+// TakeUpstream takes a request of the client from its upstream budget. When the budget is exhausted it writes
+// the 429 response and returns false, so the handler must not call the exchange.
+func TakeUpstream(ctx *fasthttp.RequestCtx) bool {
+	limiter, ok := ctx.UserValue(limiterUserValue).(*clientLimiter)
+	if !ok || limiter.upstream.Allow() {
+		return true
+	}
+
+	rejectRateLimited(ctx, limiter.client, upstreamBudget)
+
+	return false
+}
+
+func rejectRateLimited(ctx *fasthttp.RequestCtx, client string, budget string) {
+	logrus.Warnf("client '%s' exceeded its %s budget: '%s'", client, budget, ctx.RequestURI())
+	metrics.RateLimited.WithLabelValues(client, budget).Inc()
+	WriteError(ctx, http.StatusTooManyRequests, tooManyRequestsCode, "Too Many Requests")
+}
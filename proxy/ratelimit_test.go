@@ -0,0 +1,45 @@
+package proxy_test
+
+import (
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stash86/kucoin-proxy/proxy"
+	"github.com/valyala/fasthttp"
+)
+
+func TestRateLimitHandler(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+
+	cfg := &proxy.Config{ClientRate: 2, ClientUpstreamRate: 1, ClientLimits: []string{"10.0.0.2:1:0", "2001:db8::2:1:0"}}
+
+	handler := proxy.RateLimitHandler(cfg, func(ctx *fasthttp.RequestCtx) {
+		proxy.TakeUpstream(ctx)
+	})
+
+	serve := func(ip string) int {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Init(&fasthttp.Request{}, &net.TCPAddr{IP: net.ParseIP(ip)}, nil)
+		handler(ctx)
+
+		return ctx.Response.StatusCode()
+	}
+
+	// the second request of the default client fits the cache budget but not the upstream one
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests, http.StatusTooManyRequests} {
+		if got := serve("10.0.0.1"); got != want {
+			t.Errorf("default request #%d status = %d, want %d", i+1, got, want)
+		}
+	}
+
+	// the overridden clients have an unlimited upstream budget but a single request of cache budget
+	for _, ip := range []string{"10.0.0.2", "2001:db8::2"} {
+		for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+			if got := serve(ip); got != want {
+				t.Errorf("overridden %s request #%d status = %d, want %d", ip, i+1, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,347 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dgrr/websocket"
+	"github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	recordKindHTTP = "http"
+	recordKindWS   = "ws"
+
+	wsMessageTypePing = "ping"
+	wsMessageTypePong = "pong"
+)
+
+// Record is a single upstream exchange: an HTTP request/response pair or a websocket frame.
+type Record struct {
+	Ts      time.Time         `json:"ts"`
+	Kind    string            `json:"kind"`
+	Method  string            `json:"method,omitempty"`
+	URL     string            `json:"url,omitempty"`
+	Request []byte            `json:"request,omitempty"`
+	Status  int               `json:"status,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    []byte            `json:"body,omitempty"`
+	Conn    string            `json:"conn,omitempty"`
+}
+
+// Recorder appends every upstream exchange to a file as JSON lines.
+type Recorder struct {
+	l     *sync.Mutex
+	file  *os.File
+	w     *bufio.Writer
+	enc   *json.Encoder
+	conns int
+}
+
+func NewRecorder(path string) (*Recorder, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open recording '%s': %w", path, err)
+	}
+
+	w := bufio.NewWriter(file)
+
+	return &Recorder{
+		l:    new(sync.Mutex),
+		file: file,
+		w:    w,
+		enc:  json.NewEncoder(w),
+	}, nil
+}
+
+func (r *Recorder) write(record *Record) {
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	if err := r.enc.Encode(record); err != nil {
+		logrus.Errorf("recorder: failed writing record: %v", err)
+		return
+	}
+
+	if err := r.w.Flush(); err != nil {
+		logrus.Errorf("recorder: failed flushing record: %v", err)
+	}
+}
+
+func (r *Recorder) recordHTTP(req *fasthttp.Request, resp *fasthttp.Response) {
+	headers := map[string]string{}
+	resp.Header.VisitAll(func(key, value []byte) {
+		headers[string(key)] = string(value)
+	})
+
+	r.write(&Record{
+		Ts:      time.Now().UTC(),
+		Kind:    recordKindHTTP,
+		Method:  string(req.Header.Method()),
+		URL:     string(req.URI().FullURI()),
+		Request: append([]byte(nil), req.Body()...),
+		Status:  resp.StatusCode(),
+		Headers: headers,
+		Body:    append([]byte(nil), resp.Body()...),
+	})
+}
+
+func (r *Recorder) recordFrame(conn string, payload []byte) {
+	r.write(&Record{
+		Ts:   time.Now().UTC(),
+		Kind: recordKindWS,
+		Conn: conn,
+		Body: append([]byte(nil), payload...),
+	})
+}
+
+func (r *Recorder) nextConnID() string {
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	r.conns++
+
+	return strconv.Itoa(r.conns)
+}
+
+func (r *Recorder) Close() error {
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	if err := r.w.Flush(); err != nil {
+		return err
+	}
+
+	return r.file.Close()
+}
+
+// Replayer serves a recording back in place of the upstream.
+//
+// HTTP exchanges are matched by method and URL and returned in recorded order, the last one
+// repeating once exhausted. Websocket connections are handed out in the order they were recorded.
+type Replayer struct {
+	l *sync.Mutex
+
+	http    map[string][]*Record
+	httpPos map[string]int
+
+	conns    [][]*Record
+	nextConn int
+
+	speed float64
+}
+
+// NewReplayer loads a recording. Websocket frames are replayed with their recorded pauses divided
+// by speed; a speed of 0 replays them without pauses.
+func NewReplayer(path string, speed float64) (*Replayer, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open recording '%s': %w", path, err)
+	}
+	defer file.Close()
+
+	replayer := &Replayer{
+		l:       new(sync.Mutex),
+		http:    map[string][]*Record{},
+		httpPos: map[string]int{},
+		speed:   speed,
+	}
+
+	connIndex := map[string]int{}
+
+	dec := json.NewDecoder(bufio.NewReader(file))
+	for dec.More() {
+		record := &Record{}
+		if err := dec.Decode(record); err != nil {
+			return nil, fmt.Errorf("parse recording '%s': %w", path, err)
+		}
+
+		switch record.Kind {
+		case recordKindHTTP:
+			key := replayKey(record.Method, record.URL)
+			replayer.http[key] = append(replayer.http[key], record)
+		case recordKindWS:
+			i, ok := connIndex[record.Conn]
+			if !ok {
+				i = len(replayer.conns)
+				connIndex[record.Conn] = i
+				replayer.conns = append(replayer.conns, nil)
+			}
+			replayer.conns[i] = append(replayer.conns[i], record)
+		default:
+			logrus.Warnf("replayer: skipping record of unknown kind '%s'", record.Kind)
+		}
+	}
+
+	logrus.Infof("replayer: loaded %d http endpoints and %d ws connections from '%s'", len(replayer.http), len(replayer.conns), path)
+
+	return replayer, nil
+}
+
+// replayTimeArgs are query args holding times derived from the clock, e.g. a default endAt of now, which differ on
+// every run. Their values are left out of replay keys, the exchanges of a key being replayed in recorded order.
+var replayTimeArgs = []string{"startAt", "endAt"}
+
+func replayKey(method string, url string) string {
+	uri := fasthttp.AcquireURI()
+	defer fasthttp.ReleaseURI(uri)
+
+	if err := uri.Parse(nil, []byte(url)); err != nil {
+		return method + " " + url
+	}
+
+	args := uri.QueryArgs()
+	for _, name := range replayTimeArgs {
+		if args.Has(name) {
+			args.Set(name, "")
+		}
+	}
+
+	return method + " " + string(uri.FullURI())
+}
+
+func (r *Replayer) do(req *fasthttp.Request, resp *fasthttp.Response) error {
+	key := replayKey(string(req.Header.Method()), string(req.URI().FullURI()))
+
+	r.l.Lock()
+	records := r.http[key]
+	if len(records) == 0 {
+		r.l.Unlock()
+		return fmt.Errorf("replayer: no recorded exchange for '%s'", key)
+	}
+	pos := r.httpPos[key]
+	if pos < len(records)-1 {
+		r.httpPos[key] = pos + 1
+	}
+	r.l.Unlock()
+
+	record := records[pos]
+
+	resp.Reset()
+	resp.SetStatusCode(record.Status)
+	for k, v := range record.Headers {
+		resp.Header.Set(k, v)
+	}
+	resp.SetBody(record.Body)
+
+	return nil
+}
+
+func (r *Replayer) dialWS() (*replayConn, error) {
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	if r.nextConn >= len(r.conns) {
+		return nil, fmt.Errorf("replayer: no recorded ws connection #%d", r.nextConn+1)
+	}
+
+	conn := &replayConn{
+		frames: r.conns[r.nextConn],
+		speed:  r.speed,
+		pongs:  make(chan []byte, 16),
+	}
+	r.nextConn++
+
+	return conn, nil
+}
+
+// WSConn is a websocket connection to the upstream.
+type WSConn interface {
+	ReadFrame(fr *websocket.Frame) (int, error)
+	Write(b []byte) (int, error)
+}
+
+type recordingConn struct {
+	*websocket.Client
+
+	id       string
+	recorder *Recorder
+}
+
+func (c *recordingConn) ReadFrame(fr *websocket.Frame) (int, error) {
+	n, err := c.Client.ReadFrame(fr)
+	if err == nil {
+		c.recorder.recordFrame(c.id, fr.Payload())
+	}
+
+	return n, err
+}
+
+type wsControlMessage struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+}
+
+// replayConn plays recorded frames back and answers pings itself, since recorded pongs carry ids
+// of pings which are never going to be sent again.
+type replayConn struct {
+	frames []*Record
+	pos    int
+	last   time.Time
+	due    time.Time
+	speed  float64
+	pongs  chan []byte
+}
+
+func (c *replayConn) ReadFrame(fr *websocket.Frame) (int, error) {
+	for c.pos < len(c.frames) {
+		record := c.frames[c.pos]
+
+		message := &wsControlMessage{}
+		if err := json.Unmarshal(record.Body, message); err == nil && message.Type == wsMessageTypePong {
+			c.pos++
+			continue
+		}
+
+		if c.due.IsZero() {
+			c.due = time.Now()
+			if !c.last.IsZero() && c.speed > 0 {
+				c.due = c.due.Add(time.Duration(float64(record.Ts.Sub(c.last)) / c.speed))
+			}
+		}
+
+		select {
+		case pong := <-c.pongs:
+			return c.setPayload(fr, pong)
+		case <-time.After(time.Until(c.due)):
+			c.pos++
+			c.last = record.Ts
+			c.due = time.Time{}
+
+			return c.setPayload(fr, record.Body)
+		}
+	}
+
+	return c.setPayload(fr, <-c.pongs)
+}
+
+func (c *replayConn) setPayload(fr *websocket.Frame, payload []byte) (int, error) {
+	fr.SetFin()
+	fr.SetText()
+	fr.SetPayload(payload)
+
+	return len(payload), nil
+}
+
+func (c *replayConn) Write(b []byte) (int, error) {
+	message := &wsControlMessage{}
+	if err := json.Unmarshal(b, message); err != nil {
+		return 0, err
+	}
+
+	if message.Type == wsMessageTypePing {
+		pong, err := json.Marshal(wsControlMessage{ID: message.ID, Type: wsMessageTypePong})
+		if err != nil {
+			return 0, err
+		}
+		c.pongs <- pong
+	}
+
+	return len(b), nil
+}
@@ -0,0 +1,191 @@
+package proxy_test
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dgrr/websocket"
+	"github.com/stash86/kucoin-proxy/proxy"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+
+	calls := 0
+	go fasthttp.Serve(ln, func(ctx *fasthttp.RequestCtx) { //nolint:errcheck
+		calls++
+		ctx.SetStatusCode(fasthttp.StatusOK)
+		ctx.SetBodyString(`{"code":"200000","data":` + string(ctx.QueryArgs().Peek("n")) + `}`)
+	})
+
+	path := filepath.Join(t.TempDir(), "recording.jsonl")
+
+	recorder, err := proxy.NewRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &proxy.Client{
+		Client:   fasthttp.Client{Dial: func(string) (net.Conn, error) { return ln.Dial() }},
+		Recorder: recorder,
+	}
+
+	for _, url := range []string{"http://upstream/a?n=1", "http://upstream/a?n=2"} {
+		if _, _, err := client.Get(nil, url); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	replayer, err := proxy.NewReplayer(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replay := &proxy.Client{Replayer: replayer}
+
+	statusCode, body, err := replay.Get(nil, "http://upstream/a?n=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statusCode != fasthttp.StatusOK || string(body) != `{"code":"200000","data":2}` {
+		t.Errorf("replayed %d %q", statusCode, body)
+	}
+
+	if _, _, err := replay.Get(nil, "http://upstream/b"); err == nil {
+		t.Error("replaying an unrecorded exchange should fail")
+	}
+
+	if calls != 2 {
+		t.Errorf("upstream calls = %d, want 2", calls)
+	}
+
+	if conn, err := replay.DialWS("wss://upstream"); err == nil || conn != nil {
+		t.Errorf("dialing an unrecorded ws connection = %v, %v, want a nil conn and an error", conn, err)
+	}
+}
+
+func TestReplayIgnoresTimeArgs(t *testing.T) {
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+
+	go fasthttp.Serve(ln, func(ctx *fasthttp.RequestCtx) { //nolint:errcheck
+		ctx.SetBodyString(`{"code":"200000","data":"` + string(ctx.QueryArgs().Peek("endAt")) + `"}`)
+	})
+
+	path := filepath.Join(t.TempDir(), "recording.jsonl")
+	recorder, err := proxy.NewRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &proxy.Client{
+		Client:   fasthttp.Client{Dial: func(string) (net.Conn, error) { return ln.Dial() }},
+		Recorder: recorder,
+	}
+	for _, url := range []string{
+		"http://upstream/api/v1/market/candles?symbol=BTC-USDT&type=1hour&startAt=100&endAt=200",
+		"http://upstream/api/v1/market/candles?symbol=BTC-USDT&type=1hour&startAt=200&endAt=300",
+	} {
+		if _, _, err := client.Get(nil, url); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	replayer, err := proxy.NewReplayer(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replay := &proxy.Client{Replayer: replayer}
+
+	// a later run asks for other times, the exchanges are replayed in recorded order
+	for _, want := range []string{"200", "300"} {
+		_, body, err := replay.Get(nil, "http://upstream/api/v1/market/candles?symbol=BTC-USDT&type=1hour&startAt=500&endAt=600")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(body); got != `{"code":"200000","data":"`+want+`"}` {
+			t.Errorf("replayed %s, want endAt %s", got, want)
+		}
+	}
+
+	if _, _, err := replay.Get(nil, "http://upstream/api/v1/market/candles?symbol=ETH-USDT&type=1hour&startAt=500&endAt=600"); err == nil {
+		t.Error("replaying another symbol should fail")
+	}
+}
+
+func TestReplayWSFrames(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recording.jsonl")
+
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := time.Now().UTC()
+	enc := json.NewEncoder(file)
+	for i, payload := range []string{
+		`{"id":"c1","type":"welcome"}`,
+		`{"id":"p1","type":"pong"}`,
+		`{"type":"message","topic":"/market/candles:BTC-USDT_1min"}`,
+	} {
+		record := &proxy.Record{Ts: ts.Add(time.Duration(i) * time.Hour), Kind: "ws", Conn: "1", Body: []byte(payload)}
+		if err := enc.Encode(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	replayer, err := proxy.NewReplayer(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := (&proxy.Client{Replayer: replayer}).DialWS("wss://upstream")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frame := websocket.AcquireFrame()
+	defer websocket.ReleaseFrame(frame)
+
+	for _, want := range []string{
+		`{"id":"c1","type":"welcome"}`,
+		`{"type":"message","topic":"/market/candles:BTC-USDT_1min"}`,
+	} {
+		frame.Reset()
+		if _, err := conn.ReadFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+		if got := string(frame.Payload()); got != want {
+			t.Errorf("frame = %s, want %s", got, want)
+		}
+	}
+
+	if _, err := conn.Write([]byte(`{"id":"p2","type":"ping"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	frame.Reset()
+	if _, err := conn.ReadFrame(frame); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(frame.Payload()), `{"id":"p2","type":"pong"}`; got != want {
+		t.Errorf("pong = %s, want %s", got, want)
+	}
+}
@@ -2,15 +2,25 @@ package proxy
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"net"
+	"strings"
 	"time"
 
 	routing "github.com/qiangxue/fasthttp-routing"
 	"github.com/sirupsen/logrus"
+	"github.com/stash86/kucoin-proxy/metrics"
+	"github.com/stash86/kucoin-proxy/tracing"
 	"github.com/valyala/fasthttp"
 )
 
-const AnyHTTPMethod = "<ANY>"
+const (
+	AnyHTTPMethod = "<ANY>"
+
+	metricsPath = "/metrics"
+)
 
 // Route defines a single HTTP route for the proxy server.
 type Route struct {
@@ -39,36 +49,163 @@ func New(config *Config, routable Routable) *Server {
 		router.To(route.Method, path, route.Handler)
 	}
 
-	return &Server{
+	if administrable, ok := routable.(Administrable); ok && config.AdminPassword != "" {
+		admin := router.Group(adminPathPrefix, AdminAuthHandler(config))
+
+		for _, route := range administrable.AdminRoutes() {
+			path := fmt.Sprintf("/%s/%s", routable.Name(), route.Path)
+			logrus.Infof("applying admin route '%s%s' of method '%s'", adminPathPrefix, path, route.Method)
+
+			admin.To(route.Method, path, route.Handler)
+		}
+	}
+
+	metricsHandler := metrics.Handler()
+	metricsRoute := func(c *routing.Context) error {
+		metricsHandler(c.RequestCtx)
+		return nil
+	}
+
+	// metrics are public unless the admin credentials are configured
+	if config.AdminPassword != "" {
+		router.Get(metricsPath, AdminAuthHandler(config), metricsRoute)
+	} else {
+		router.Get(metricsPath, metricsRoute)
+	}
+	logrus.Infof("applying metrics route '%s'", metricsPath)
+
+	server := &Server{
 		server: &fasthttp.Server{
-			Handler:     router.HandleRequest,
+			Handler:     tracing.Handler(AccessLogHandler(CompressHandler(ClientAuthHandler(config, RateLimitHandler(config, router.HandleRequest))))),
 			Concurrency: config.ConcurrencyLimit,
 		},
 		config: config,
 	}
+
+	if config.DebugAddr != "" {
+		server.debug = &fasthttp.Server{Handler: DebugHandler(config)}
+	}
+
+	return server
 }
 
 type Server struct {
-	config *Config
-	server *fasthttp.Server
+	config     *Config
+	server     *fasthttp.Server
+	debug      *fasthttp.Server
+	onShutdown []func()
+}
+
+// OnShutdown registers fn to run once the server stopped on GracefulShutdown.
+func (s *Server) OnShutdown(fn func()) {
+	s.onShutdown = append(s.onShutdown, fn)
 }
 
 func (s *Server) Address() string {
-	return fmt.Sprintf("%s:%s", s.config.Bindaddr, s.config.Port)
+	return net.JoinHostPort(s.config.Bindaddr, s.config.Port)
+}
+
+// Addresses returns the addresses the server listens on, listen overriding bindaddr and port.
+func (s *Server) Addresses() []string {
+	if len(s.config.Listen) > 0 {
+		return s.config.Listen
+	}
+
+	return []string{s.Address()}
 }
 
+// Serve listens on every address and returns once they all stopped on shutdown, or any of them failed.
 func (s *Server) Serve() error {
-	addr := s.Address()
-	logrus.Infof("starting proxy server on %s...", addr)
-	if err := s.server.ListenAndServe(addr); err != nil {
+	tlsConfig, err := newTLSConfig(s.config)
+	if err != nil {
+		return fmt.Errorf("server failed: %w", err)
+	}
+
+	socketMode, err := parseSocketMode(s.config.SocketMode)
+	if err != nil {
 		return fmt.Errorf("server failed: %w", err)
 	}
+
+	addresses := s.Addresses()
+	servers := make([]*fasthttp.Server, 0, len(addresses)+1)
+	for range addresses {
+		servers = append(servers, s.server)
+	}
+	if s.debug != nil {
+		addresses = append(addresses, s.config.DebugAddr)
+		servers = append(servers, s.debug)
+	}
+
+	listeners := make([]net.Listener, 0, len(addresses))
+	for i, addr := range addresses {
+		ln, err := listen(addr, socketMode)
+		if err != nil {
+			for _, opened := range listeners {
+				opened.Close()
+			}
+			return fmt.Errorf("server failed: %w", err)
+		}
+
+		name := "proxy"
+		if servers[i] == s.debug {
+			name = "debug"
+		}
+
+		// the debug listener is for the host only, authenticated by the admin credentials alone
+		if tlsConfig != nil && servers[i] != s.debug {
+			ln = tls.NewListener(ln, tlsConfig)
+			logrus.Infof("starting %s server on %s with tls...", name, addr)
+		} else {
+			logrus.Infof("starting %s server on %s...", name, addr)
+		}
+
+		listeners = append(listeners, ln)
+	}
+
+	errCh := make(chan error, len(listeners))
+	for i, ln := range listeners {
+		go func(server *fasthttp.Server, ln net.Listener) {
+			errCh <- server.Serve(ln)
+		}(servers[i], ln)
+	}
+
+	for served := range listeners {
+		if err := <-errCh; err != nil {
+			// the other listeners would keep serving after Serve returned, and leave their unix sockets behind
+			s.stop(listeners)
+			for i := served + 1; i < len(listeners); i++ {
+				<-errCh
+			}
+
+			return fmt.Errorf("server failed: %w", err)
+		}
+	}
 	return nil
 }
 
+// stop closes the listeners, which removes unix sockets, and the connections still open on them.
+func (s *Server) stop(listeners []net.Listener) {
+	for _, ln := range listeners {
+		ln.Close() //nolint:errcheck
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// the listeners being closed already, only the connections are left to the servers
+	if err := s.server.ShutdownWithContext(ctx); err != nil && !errors.Is(err, net.ErrClosed) {
+		logrus.Errorf("closing connections of the proxy server: %v", err)
+	}
+	if s.debug != nil {
+		if err := s.debug.ShutdownWithContext(ctx); err != nil && !errors.Is(err, net.ErrClosed) {
+			logrus.Errorf("closing connections of the debug server: %v", err)
+		}
+	}
+}
+
 // GracefulShutdown shuts down the server gracefully and logs the reason.
 func (s *Server) GracefulShutdown(ctx context.Context, reason string) error {
-	addr := s.Address()
+	addr := strings.Join(s.Addresses(), ", ")
 	start := time.Now()
 	if deadline, ok := ctx.Deadline(); ok {
 		logrus.Infof("shutting down proxy server on %s: %s (deadline: %s)", addr, reason, deadline.Format(time.RFC3339))
@@ -81,6 +218,14 @@ func (s *Server) GracefulShutdown(ctx context.Context, reason string) error {
 	} else {
 		err = s.server.Shutdown()
 	}
+	if s.debug != nil {
+		if debugErr := s.debug.ShutdownWithContext(ctx); debugErr != nil && err == nil {
+			err = debugErr
+		}
+	}
+	for _, fn := range s.onShutdown {
+		fn()
+	}
 	dur := time.Since(start)
 	if err != nil {
 		logrus.Errorf("error during shutdown after %s: %v", dur, err)
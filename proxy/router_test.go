@@ -2,12 +2,16 @@ package proxy_test
 
 import (
 	"context"
+	"net"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	routing "github.com/qiangxue/fasthttp-routing"
 	"github.com/sirupsen/logrus"
 	"github.com/stash86/kucoin-proxy/proxy"
+	"github.com/valyala/fasthttp"
 )
 
 type dummyRoutable struct{}
@@ -53,3 +57,55 @@ func TestServeReturnsError(t *testing.T) {
 		t.Error("Serve() should return error for invalid address")
 	}
 }
+
+func TestServerAddressIPv6(t *testing.T) {
+	cfg := &proxy.Config{Port: "1234", Bindaddr: "::1", ConcurrencyLimit: fasthttp.DefaultConcurrency}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := proxy.New(cfg, dummyRoutable{}).Address(), "[::1]:1234"; got != want {
+		t.Errorf("Address() = %q, want %q", got, want)
+	}
+}
+
+func TestServeUnixSocket(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+	cfg := &proxy.Config{
+		Port:             "1234",
+		Bindaddr:         "127.0.0.1",
+		ConcurrencyLimit: fasthttp.DefaultConcurrency,
+		Listen:           []string{"unix://" + path},
+		SocketMode:       "0600",
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := proxy.New(cfg, dummyRoutable{})
+	go srv.Serve()                                           //nolint:errcheck
+	defer srv.GracefulShutdown(context.Background(), "test") //nolint:errcheck
+
+	client := &fasthttp.Client{Dial: func(string) (net.Conn, error) { return net.Dial("unix", path) }}
+
+	var statusCode int
+	var err error
+	for i := 0; i < 50; i++ {
+		if statusCode, _, err = client.Get(nil, "http://proxy/dummy/test"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil || statusCode != fasthttp.StatusOK {
+		t.Fatalf("status = %d, err = %v", statusCode, err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0o600 {
+		t.Errorf("socket mode = %o, want 600", mode)
+	}
+}
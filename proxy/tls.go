@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// certCheckInterval throttles checking the certificate files for changes.
+const certCheckInterval = time.Second
+
+// certReloader serves the certificate of the files, reloading it once they change.
+type certReloader struct {
+	l        *sync.Mutex
+	certFile string
+	keyFile  string
+
+	cert      *tls.Certificate
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	r := &certReloader{l: new(sync.Mutex), certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// lastModified returns the time either of the files was last modified.
+func (r *certReloader) lastModified() (time.Time, error) {
+	var modTime time.Time
+	for _, file := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+
+	return modTime, nil
+}
+
+func (r *certReloader) reload() error {
+	modTime, err := r.lastModified()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("load certificate '%s': %w", r.certFile, err)
+	}
+
+	r.cert = &cert
+	r.modTime = modTime
+
+	return nil
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	if time.Since(r.checkedAt) < certCheckInterval {
+		return r.cert, nil
+	}
+	r.checkedAt = time.Now()
+
+	if modTime, err := r.lastModified(); err != nil || !modTime.After(r.modTime) {
+		return r.cert, nil
+	}
+
+	// a certificate being rewritten may not parse yet, the previous one is served until it does
+	if err := r.reload(); err != nil {
+		logrus.Warnf("failed reloading certificate, keeping the previous one: %v", err)
+		return r.cert, nil
+	}
+
+	logrus.Infof("reloaded certificate '%s'", r.certFile)
+
+	return r.cert, nil
+}
+
+// newTLSConfig returns the tls config of the server, nil if tls is disabled. With a client CA, clients must
+// present a certificate it signed, unless they may authenticate with credentials instead.
+func newTLSConfig(config *Config) (*tls.Config, error) {
+	if config.TLSCert == "" {
+		return nil, nil
+	}
+
+	reloader, err := newCertReloader(config.TLSCert, config.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	if config.TLSClientCA != "" {
+		pem, err := os.ReadFile(config.TLSClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("read client CA '%s': %w", config.TLSClientCA, err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in client CA '%s'", config.TLSClientCA)
+		}
+
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		if len(config.Clients) > 0 {
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,202 @@
+package proxy_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	routing "github.com/qiangxue/fasthttp-routing"
+	"github.com/sirupsen/logrus"
+	"github.com/stash86/kucoin-proxy/proxy"
+	"github.com/valyala/fasthttp"
+)
+
+type clientNameRoutable struct{}
+
+func (clientNameRoutable) Routes() []proxy.Route {
+	return []proxy.Route{
+		{
+			Path:   "whoami",
+			Method: "GET",
+			Handler: func(c *routing.Context) error {
+				c.SetBodyString(proxy.ClientName(c.RequestCtx))
+				return nil
+			},
+		},
+	}
+}
+
+func (clientNameRoutable) Name() string { return "test" }
+
+// issue writes a certificate of the common name signed by the parent, self-signed if it is nil.
+func issue(t *testing.T, dir string, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for file, block := range map[string]*pem.Block{
+		cn + ".crt": {Type: "CERTIFICATE", Bytes: der},
+		cn + ".key": {Type: "EC PRIVATE KEY", Bytes: keyDer},
+	} {
+		if err := os.WriteFile(filepath.Join(dir, file), pem.EncodeToMemory(block), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return cert, key
+}
+
+func freePort(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	return strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+}
+
+func TestServeMutualTLS(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+
+	dir := t.TempDir()
+	ca, caKey := issue(t, dir, "ca", nil, nil)
+	issue(t, dir, "server", ca, caKey)
+	issue(t, dir, "bot1", ca, caKey)
+
+	cfg := &proxy.Config{
+		Port:             freePort(t),
+		Bindaddr:         "127.0.0.1",
+		ConcurrencyLimit: fasthttp.DefaultConcurrency,
+		TLSCert:          filepath.Join(dir, "server.crt"),
+		TLSKey:           filepath.Join(dir, "server.key"),
+		TLSClientCA:      filepath.Join(dir, "ca.crt"),
+	}
+
+	srv := proxy.New(cfg, clientNameRoutable{})
+	go srv.Serve()                                  //nolint:errcheck
+	defer srv.GracefulShutdown(t.Context(), "test") //nolint:errcheck
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	clientCert, err := tls.LoadX509KeyPair(filepath.Join(dir, "bot1.crt"), filepath.Join(dir, "bot1.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := "https://127.0.0.1:" + cfg.Port + "/test/whoami"
+
+	var body []byte
+	for i := 0; i < 50; i++ {
+		client := &fasthttp.Client{TLSConfig: &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{clientCert}}}
+		var statusCode int
+		if statusCode, body, err = client.Get(nil, url); err == nil && statusCode == fasthttp.StatusOK {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "bot1" {
+		t.Errorf("client name = %q, want bot1", body)
+	}
+
+	anonymous := &fasthttp.Client{TLSConfig: &tls.Config{RootCAs: roots}}
+	if _, _, err := anonymous.Get(nil, url); err == nil {
+		t.Error("a client without certificate was served")
+	}
+}
+
+func TestServeDebugWithoutTLS(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+
+	dir := t.TempDir()
+	ca, caKey := issue(t, dir, "ca", nil, nil)
+	issue(t, dir, "server", ca, caKey)
+
+	cfg := &proxy.Config{
+		Port:             freePort(t),
+		Bindaddr:         "127.0.0.1",
+		ConcurrencyLimit: fasthttp.DefaultConcurrency,
+		TLSCert:          filepath.Join(dir, "server.crt"),
+		TLSKey:           filepath.Join(dir, "server.key"),
+		TLSClientCA:      filepath.Join(dir, "ca.crt"),
+		AdminUser:        "admin",
+		AdminPassword:    "secret",
+		DebugAddr:        "127.0.0.1:" + freePort(t),
+	}
+
+	srv := proxy.New(cfg, clientNameRoutable{})
+	go srv.Serve()                                  //nolint:errcheck
+	defer srv.GracefulShutdown(t.Context(), "test") //nolint:errcheck
+
+	// neither tls nor a client certificate is required by the debug listener
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	req.SetRequestURI("http://" + cfg.DebugAddr + "/debug/pprof/cmdline")
+	req.Header.Set("Authorization", "Basic YWRtaW46c2VjcmV0")
+
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+
+	var err error
+	for i := 0; i < 50; i++ {
+		if err = fasthttp.Do(req, resp); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode() != fasthttp.StatusOK {
+		t.Errorf("status = %d, want 200", resp.StatusCode())
+	}
+}
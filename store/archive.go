@@ -0,0 +1,290 @@
+package store
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stash86/kucoin-proxy/model"
+)
+
+const (
+	archiveCandlesExt = ".candles"
+	archiveSpansExt   = ".spans"
+
+	// ts followed by open, high, low, close, volume and amount
+	archiveCandleSize = 8 * 7
+	// from and to
+	archiveSpanSize = 8 * 2
+)
+
+// Archive is an append-only on-disk tier behind Store holding closed candles per key.
+//
+// Alongside candles it keeps the spans that were fetched from the upstream in full, so that a range
+// without candles (no trades) is told apart from a range that was never fetched.
+type Archive struct {
+	l     *sync.Mutex
+	dir   string
+	files map[string]*archiveFile
+}
+
+type archiveEntry struct {
+	ts     int64
+	offset int64
+}
+
+type archiveFile struct {
+	l       *sync.RWMutex
+	candles *os.File
+	spans   *os.File
+	size    int64
+	index   []archiveEntry
+	covered []Span
+}
+
+func NewArchive(dir string) (*Archive, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create archive dir '%s': %w", dir, err)
+	}
+
+	return &Archive{
+		l:     new(sync.Mutex),
+		dir:   dir,
+		files: map[string]*archiveFile{},
+	}, nil
+}
+
+func (a *Archive) file(key string) (*archiveFile, error) {
+	a.l.Lock()
+	defer a.l.Unlock()
+
+	if f, ok := a.files[key]; ok {
+		return f, nil
+	}
+
+	base := filepath.Join(a.dir, url.PathEscape(key))
+	f, err := openArchiveFile(base)
+	if err != nil {
+		return nil, err
+	}
+
+	logrus.Infof("archive: opened '%s' with %d candles and %d spans", key, len(f.index), len(f.covered))
+	a.files[key] = f
+
+	return f, nil
+}
+
+// openArchiveFile loads the index of an archive, dropping a partially written trailing record.
+func openArchiveFile(base string) (*archiveFile, error) {
+	candles, err := os.OpenFile(base+archiveCandlesExt, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	spans, err := os.OpenFile(base+archiveSpansExt, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		candles.Close()
+		return nil, err
+	}
+
+	f := &archiveFile{l: new(sync.RWMutex), candles: candles, spans: spans}
+
+	if f.size, err = truncateToRecords(candles, archiveCandleSize); err != nil {
+		return nil, err
+	}
+
+	buff := make([]byte, archiveCandleSize)
+	for offset := int64(0); offset < f.size; offset += archiveCandleSize {
+		if _, err := candles.ReadAt(buff, offset); err != nil {
+			return nil, err
+		}
+		f.insertIndex(archiveEntry{ts: int64(binary.LittleEndian.Uint64(buff)), offset: offset})
+	}
+
+	spansSize, err := truncateToRecords(spans, archiveSpanSize)
+	if err != nil {
+		return nil, err
+	}
+
+	buff = make([]byte, archiveSpanSize)
+	for offset := int64(0); offset < spansSize; offset += archiveSpanSize {
+		if _, err := spans.ReadAt(buff, offset); err != nil {
+			return nil, err
+		}
+		f.covered = cover(f.covered, Span{
+			From: time.Unix(int64(binary.LittleEndian.Uint64(buff)), 0).UTC(),
+			To:   time.Unix(int64(binary.LittleEndian.Uint64(buff[8:])), 0).UTC(),
+		})
+	}
+
+	return f, nil
+}
+
+func truncateToRecords(file *os.File, recordSize int64) (int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	size := info.Size() - info.Size()%recordSize
+	if size != info.Size() {
+		logrus.Warnf("archive: dropping partial record at the end of '%s'", file.Name())
+		if err := file.Truncate(size); err != nil {
+			return 0, err
+		}
+	}
+
+	return size, nil
+}
+
+// insertIndex keeps the index sorted by ts, the first stored candle of a ts wins.
+func (f *archiveFile) insertIndex(entry archiveEntry) bool {
+	i := sort.Search(len(f.index), func(i int) bool { return f.index[i].ts >= entry.ts })
+	if i < len(f.index) && f.index[i].ts == entry.ts {
+		return false
+	}
+
+	f.index = append(f.index, archiveEntry{})
+	copy(f.index[i+1:], f.index[i:])
+	f.index[i] = entry
+
+	return true
+}
+
+// Store appends closed candles of the key and marks span as fully fetched.
+func (a *Archive) Store(key string, span Span, candles ...*model.Candle) error {
+	f, err := a.file(key)
+	if err != nil {
+		return err
+	}
+
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	buff := make([]byte, archiveCandleSize)
+	for _, c := range candles {
+		if c == nil || c.Synthetic {
+			continue
+		}
+
+		entry := archiveEntry{ts: c.Ts.Unix(), offset: f.size}
+		if !f.insertIndex(entry) {
+			continue
+		}
+
+		encodeArchiveCandle(buff, c)
+		if _, err := f.candles.WriteAt(buff, f.size); err != nil {
+			return fmt.Errorf("archive '%s': %w", key, err)
+		}
+		f.size += archiveCandleSize
+	}
+
+	if !span.From.Before(span.To) {
+		return nil
+	}
+
+	// the candles reach the disk before the span covering them, a crash in between only costs a refetch
+	if err := f.candles.Sync(); err != nil {
+		return fmt.Errorf("archive '%s': %w", key, err)
+	}
+
+	buff = buff[:archiveSpanSize]
+	binary.LittleEndian.PutUint64(buff, uint64(span.From.Unix()))
+	binary.LittleEndian.PutUint64(buff[8:], uint64(span.To.Unix()))
+	if _, err := f.spans.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+	if _, err := f.spans.Write(buff); err != nil {
+		return fmt.Errorf("archive '%s': %w", key, err)
+	}
+
+	f.covered = cover(f.covered, span)
+
+	return nil
+}
+
+// Missing returns the parts of span which were never fetched into the archive.
+func (a *Archive) Missing(key string, span Span) ([]Span, error) {
+	f, err := a.file(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f.l.RLock()
+	defer f.l.RUnlock()
+
+	return missing(f.covered, span), nil
+}
+
+// Get returns archived candles with from <= ts <= to, newest first like Store.Get.
+func (a *Archive) Get(key string, from time.Time, to time.Time) ([]*model.Candle, error) {
+	f, err := a.file(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f.l.RLock()
+	defer f.l.RUnlock()
+
+	lo := sort.Search(len(f.index), func(i int) bool { return f.index[i].ts >= from.Unix() })
+	hi := sort.Search(len(f.index), func(i int) bool { return f.index[i].ts > to.Unix() })
+
+	candles := make([]*model.Candle, 0, hi-lo)
+	buff := make([]byte, archiveCandleSize)
+	for i := hi - 1; i >= lo; i-- {
+		if _, err := f.candles.ReadAt(buff, f.index[i].offset); err != nil {
+			return nil, fmt.Errorf("archive '%s': %w", key, err)
+		}
+		candles = append(candles, decodeArchiveCandle(buff))
+	}
+
+	return candles, nil
+}
+
+func (a *Archive) Close() error {
+	a.l.Lock()
+	defer a.l.Unlock()
+
+	for key, f := range a.files {
+		if err := f.candles.Close(); err != nil {
+			return err
+		}
+		if err := f.spans.Close(); err != nil {
+			return err
+		}
+		delete(a.files, key)
+	}
+
+	return nil
+}
+
+func encodeArchiveCandle(buff []byte, c *model.Candle) {
+	binary.LittleEndian.PutUint64(buff, uint64(c.Ts.Unix()))
+	for i, v := range []float64{c.Open, c.High, c.Low, c.Close, c.Volume, c.Amount} {
+		binary.LittleEndian.PutUint64(buff[8*(i+1):], math.Float64bits(v))
+	}
+}
+
+func decodeArchiveCandle(buff []byte) *model.Candle {
+	field := func(i int) float64 {
+		return math.Float64frombits(binary.LittleEndian.Uint64(buff[8*i:]))
+	}
+
+	return &model.Candle{
+		Ts:     time.Unix(int64(binary.LittleEndian.Uint64(buff)), 0).UTC(),
+		Open:   field(1),
+		High:   field(2),
+		Low:    field(3),
+		Close:  field(4),
+		Volume: field(5),
+		Amount: field(6),
+	}
+}
@@ -0,0 +1,78 @@
+package store_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stash86/kucoin-proxy/model"
+	"github.com/stash86/kucoin-proxy/store"
+)
+
+func TestArchiveSurvivesReopen(t *testing.T) {
+	dir := t.TempDir()
+	ts := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	archive, err := store.NewArchive(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = archive.Store("key", store.Span{From: ts, To: ts.Add(3 * time.Hour)},
+		&model.Candle{Ts: ts.Add(2 * time.Hour), Close: 3},
+		&model.Candle{Ts: ts, Close: 1},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := archive.Store("key", store.Span{From: ts.Add(5 * time.Hour), To: ts.Add(6 * time.Hour)}, &model.Candle{Ts: ts.Add(5 * time.Hour), Close: 6}); err != nil {
+		t.Fatal(err)
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate a write interrupted in the middle of a record
+	f, err := os.OpenFile(filepath.Join(dir, "key.candles"), os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	archive, err = store.NewArchive(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+
+	candles, err := archive.Get("key", ts, ts.Add(5*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candles) != 3 || candles[0].Close != 6 || candles[1].Close != 3 || candles[2].Close != 1 {
+		t.Errorf("Get() = %+v, want 3 candles newest first", candles)
+	}
+
+	missing, err := archive.Missing("key", store.Span{From: ts.Add(-time.Hour), To: ts.Add(7 * time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []store.Span{
+		{From: ts.Add(-time.Hour), To: ts},
+		{From: ts.Add(3 * time.Hour), To: ts.Add(5 * time.Hour)},
+		{From: ts.Add(6 * time.Hour), To: ts.Add(7 * time.Hour)},
+	}
+	if len(missing) != len(want) {
+		t.Fatalf("Missing() = %v, want %v", missing, want)
+	}
+	for i := range want {
+		if !missing[i].From.Equal(want[i].From) || !missing[i].To.Equal(want[i].To) {
+			t.Errorf("Missing()[%d] = %v, want %v", i, missing[i], want[i])
+		}
+	}
+}
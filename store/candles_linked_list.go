@@ -2,6 +2,8 @@
 package store
 
 import (
+	"sync/atomic"
+
 	"github.com/sirupsen/logrus"
 	"github.com/stash86/kucoin-proxy/model"
 )
@@ -10,6 +12,16 @@ type candlesLinkedList struct {
 	first *element
 	last  *element
 	len   int
+
+	// accessed is the unix nano time the bucket was last read, updated under the read lock
+	accessed atomic.Int64
+	// updated is the unix nano time a candle was last stored into the bucket
+	updated atomic.Int64
+
+	// verified are the sorted spans known to hold every candle there is, guarded by the store lock
+	verified []Span
+	// extended are the sorted spans verified by websocket updates alone, dropped once the updates skip a period
+	extended []Span
 }
 
 type element struct {
@@ -59,6 +71,33 @@ func (list *candlesLinkedList) prepend(values ...*model.Candle) {
 	}
 }
 
+// insertBefore links the value in front of the element, or at the end of the list if the element is nil.
+func (list *candlesLinkedList) insertBefore(e *element, value *model.Candle) *element {
+	newElement := &element{value: value, next: e}
+
+	if e == nil {
+		newElement.prev = list.last
+		if list.last != nil {
+			list.last.next = newElement
+		} else {
+			list.first = newElement
+		}
+		list.last = newElement
+	} else {
+		newElement.prev = e.prev
+		if e.prev != nil {
+			e.prev.next = newElement
+		} else {
+			list.first = newElement
+		}
+		e.prev = newElement
+	}
+
+	list.len++
+
+	return newElement
+}
+
 func (list *candlesLinkedList) get(index int) (*model.Candle, bool) {
 	if !list.withinRange(index) {
 		return nil, false
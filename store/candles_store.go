@@ -1,32 +1,78 @@
 package store
 
 import (
+	"fmt"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/stash86/kucoin-proxy/metrics"
 	"github.com/stash86/kucoin-proxy/model"
 )
 
-var candlePool = sync.Pool{
-	New: func() interface{} { return new(model.Candle) },
+// GapMode defines how the store fills periods skipped between two candles.
+type GapMode string
+
+const (
+	// GapPaint fills skipped periods with synthetic copies of the previous candle without volume.
+	GapPaint GapMode = "paint"
+	// GapSkip leaves skipped periods empty.
+	GapSkip GapMode = "skip"
+	// GapBackfill paints skipped periods and hands them to the gap handler to be refetched.
+	GapBackfill GapMode = "backfill"
+)
+
+func ParseGapMode(mode string) (GapMode, error) {
+	switch GapMode(mode) {
+	case GapPaint, GapSkip, GapBackfill:
+		return GapMode(mode), nil
+	}
+
+	return "", fmt.Errorf("unknown gap mode '%s'", mode)
 }
 
 type Store struct {
 	l           *sync.RWMutex
 	mappedLists map[string]*candlesLinkedList
 	cacheSize   int
+	gapMode     GapMode
+	onGap       func(key string, gap Span)
+	onEvict     func(key string)
+	maxCandles  int
+	candles     int
 	logCache    sync.Map // for log rate limiting, now thread-safe
 }
 
-func NewStore(cacheSize int) *Store {
+func NewStore(cacheSize int, gapMode GapMode) *Store {
 	return &Store{
 		l:           new(sync.RWMutex),
 		mappedLists: map[string]*candlesLinkedList{},
 		cacheSize:   cacheSize,
+		gapMode:     gapMode,
 	}
 }
 
+// OnGap sets the handler of skipped periods in GapBackfill mode. It is called outside of the store lock.
+func (s *Store) OnGap(fn func(key string, gap Span)) {
+	s.onGap = fn
+}
+
+// LimitCandles sets the global budget of candles across all buckets, 0 meaning unlimited. Once it is
+// exceeded the least recently read buckets are evicted.
+func (s *Store) LimitCandles(maxCandles int) {
+	s.maxCandles = maxCandles
+}
+
+// OnEvict sets the handler of buckets evicted to keep the candles budget. It is called outside of the store lock.
+func (s *Store) OnEvict(fn func(key string)) {
+	s.onEvict = fn
+}
+
+func (s *Store) CacheSize() int {
+	return s.cacheSize
+}
+
 func (s *Store) Store(key string, period time.Duration, candles ...*model.Candle) {
 	if len(candles) == 0 {
 		return
@@ -37,81 +83,317 @@ func (s *Store) Store(key string, period time.Duration, candles ...*model.Candle
 	if bucket == nil {
 		logrus.Infof("creating new bucket for key '%s'", key)
 		bucket = newCandlesLinkedList()
+		bucket.accessed.Store(time.Now().UnixNano())
 		s.mappedLists[key] = bucket
+		metrics.CachedBuckets.Set(float64(len(s.mappedLists)))
 	}
-	s.l.Unlock()
 
+	gaps := make([]Span, 0)
+
+	// candles usually come sorted, so the search for the next one starts from the previous one
+	var hint *element
+
+	// the lock is held throughout, a bucket evicted in between would take the candles and their count along
 	for _, c := range candles {
 		if c == nil {
 			logrus.Warnf("skipping nil candle for key '%s'", key)
 			continue
 		}
 
-		// Only lock for writing if we are modifying the bucket
-		s.l.Lock()
-		if bucket.first != nil {
-			steps := c.Ts.Sub(bucket.first.value.Ts) / period
-			if steps > 1 {
-				painted := candlePool.Get().(*model.Candle)
-				*painted = *bucket.first.value // copy fields
-				for i := 1; i < int(steps); i++ {
-					painted.Ts = painted.Ts.Add(period)
-					painted.Volume = 0
-					painted.Amount = 0
-					// Log at most once per minute per key (thread-safe)
-					if lastVal, ok := s.logCache.Load(key); !ok || time.Since(lastVal.(time.Time)) > time.Minute {
-						logrus.Warnf("saving painted candle: ts '%s' for '%s'...", painted.Ts, key)
-						s.logCache.Store(key, time.Now())
-					}
-					s.store(bucket, painted)
+		size := bucket.size()
+		var painted []Span
+		hint, painted = s.store(key, bucket, period, c, hint)
+		gaps = append(gaps, painted...)
+
+		if bucket.size() > s.cacheSize {
+			logrus.Debugf("trimming bucket for key '%s' to cache size %d", key, s.cacheSize)
+			for bucket.size() > s.cacheSize {
+				if bucket.last == hint {
+					hint = nil
 				}
-				candlePool.Put(painted)
+				bucket.remove(bucket.size() - 1)
 			}
 		}
-		s.store(bucket, c)
-		if bucket.size() > s.cacheSize {
-			logrus.Infof("trimming bucket for key '%s' to cache size %d", key, s.cacheSize)
-			bucket.remove(s.cacheSize)
+		s.clip(bucket)
+		s.candles += bucket.size() - size
+		bucket.updated.Store(time.Now().UnixNano())
+	}
+	s.l.Unlock()
+
+	for _, evicted := range s.keepBudget(key) {
+		if s.onEvict != nil {
+			s.onEvict(evicted)
+		}
+	}
+
+	if s.onGap != nil && s.gapMode == GapBackfill {
+		for _, gap := range gaps {
+			s.onGap(key, gap)
+		}
+	}
+}
+
+// store inserts the candle keeping the bucket sorted newest first with unique ts. A real candle replaces
+// a painted one of the same ts, never the other way round. The search starts from hint when it is newer
+// than the candle. It returns the element of the candle and the gaps painted around it.
+func (s *Store) store(key string, bucket *candlesLinkedList, period time.Duration, candle *model.Candle, hint *element) (*element, []Span) {
+	at := bucket.first
+	if hint != nil && hint.value.Ts.After(candle.Ts) {
+		at = hint
+	}
+	for at != nil && at.value.Ts.After(candle.Ts) {
+		at = at.next
+	}
+
+	if at != nil && at.value.Ts.Equal(candle.Ts) {
+		if candle.Synthetic && !at.value.Synthetic {
+			return at, nil
+		}
+
+		logrus.Tracef("%s - update", candle.Ts.String())
+		at.value = candle
+		s.repaint(key, at)
+
+		return at, nil
+	}
+
+	if at == nil && bucket.size() >= s.cacheSize {
+		logrus.Tracef("%s - older than a full bucket", candle.Ts.String())
+		return nil, nil
+	}
+
+	logrus.Tracef("%s - insert", candle.Ts.String())
+	inserted := bucket.insertBefore(at, candle)
+
+	gaps := make([]Span, 0)
+	if newer := inserted.prev; newer != nil {
+		if gap, ok := s.paint(key, bucket, period, inserted, newer); ok {
+			gaps = append(gaps, gap)
 		}
-		s.l.Unlock()
 	}
+	if at != nil {
+		if gap, ok := s.paint(key, bucket, period, at, inserted); ok {
+			gaps = append(gaps, gap)
+		}
+	}
+	s.repaint(key, inserted)
+
+	return inserted, gaps
 }
 
-func (s *Store) store(bucket *candlesLinkedList, candle *model.Candle) {
-	first, ok := bucket.get(0)
-	if ok && first.Ts.Equal(candle.Ts) {
-		logrus.Tracef("%s %s - update first", first.Ts.String(), candle.Ts.String())
-		bucket.set(0, candle)
+// clip drops what a full bucket verified before its oldest candle, as older candles are not kept.
+func (s *Store) clip(bucket *candlesLinkedList) {
+	if bucket.size() < s.cacheSize || bucket.last == nil {
+		return
+	}
 
+	oldest := bucket.last.value.Ts
+	bucket.verified = clipSpans(bucket.verified, oldest)
+	bucket.extended = clipSpans(bucket.extended, oldest)
+}
+
+// clipSpans drops the parts of the spans before oldest.
+func clipSpans(spans []Span, oldest time.Time) []Span {
+	clipped := make([]Span, 0, len(spans))
+	for _, span := range spans {
+		if !span.To.After(oldest) {
+			continue
+		}
+		if span.From.Before(oldest) {
+			span.From = oldest
+		}
+		clipped = append(clipped, span)
+	}
+
+	return clipped
+}
+
+// Verify marks span of the key as fetched in full from the upstream. Nothing is verified for a key
+// without a bucket.
+func (s *Store) Verify(key string, span Span) {
+	if !span.From.Before(span.To) {
 		return
 	}
 
-	if bucket.size() == s.cacheSize {
-		bucket.remove(s.cacheSize - 1)
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	bucket := s.mappedLists[key]
+	if bucket == nil {
+		return
 	}
 
-	if ok && first.Ts.Before(candle.Ts) {
-		logrus.Tracef("%s %s - prepend", first.Ts.String(), candle.Ts.String())
-		bucket.prepend(candle)
-	} else {
-		if first != nil {
-			logrus.Tracef("%s %s - append", first.Ts.String(), candle.Ts.String())
+	bucket.verified = cover(bucket.verified, span)
+	s.clip(bucket)
+}
+
+// Extend verifies the period starting at ts when it continues what the key has verified, as the websocket
+// sends the candles of a key without holes. An update skipping past what is verified drops every extension.
+func (s *Store) Extend(key string, period time.Duration, ts time.Time) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	bucket := s.mappedLists[key]
+	if bucket == nil {
+		return
+	}
+
+	for _, span := range known(bucket) {
+		if !ts.Before(span.From) && !ts.After(span.To) {
+			bucket.extended = cover(bucket.extended, Span{From: ts, To: ts.Add(period)})
+			s.clip(bucket)
+			return
 		}
+	}
+
+	bucket.extended = nil
+}
 
-		bucket.append(candle)
+// DropExtended forgets what websocket updates verified for the key, e.g. once they may have been missed.
+func (s *Store) DropExtended(key string) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	if bucket := s.mappedLists[key]; bucket != nil {
+		bucket.extended = nil
+	}
+}
+
+// Missing returns the parts of span of the key which are neither verified nor extended.
+func (s *Store) Missing(key string, span Span) []Span {
+	s.l.RLock()
+	defer s.l.RUnlock()
+
+	bucket := s.mappedLists[key]
+	if bucket == nil {
+		return missing(nil, span)
 	}
+
+	return missing(known(bucket), span)
+}
+
+// known merges the verified and extended spans of the bucket, the store lock must be held.
+func known(bucket *candlesLinkedList) []Span {
+	spans := append([]Span{}, bucket.verified...)
+	for _, span := range bucket.extended {
+		spans = cover(spans, span)
+	}
+
+	return spans
+}
+
+// paint fills the periods skipped between two neighbour candles with synthetic copies of the older one,
+// at most cache size of the newest ones.
+func (s *Store) paint(key string, bucket *candlesLinkedList, period time.Duration, older *element, newer *element) (Span, bool) {
+	steps := int(newer.value.Ts.Sub(older.value.Ts) / period)
+	if steps <= 1 {
+		return Span{}, false
+	}
+
+	if s.gapMode != GapSkip {
+		first := 1
+		if steps-1 > s.cacheSize {
+			first = steps - s.cacheSize
+		}
+
+		// every painted candle is linked right after the older one, so the newest goes first
+		for i := steps - 1; i >= first; i-- {
+			bucket.insertBefore(older, s.painted(key, older.value, older.value.Ts.Add(period*time.Duration(i))))
+		}
+	}
+
+	return Span{From: older.value.Ts.Add(period), To: newer.value.Ts}, true
+}
+
+// repaint refreshes painted candles following the element, as they copy it.
+func (s *Store) repaint(key string, e *element) {
+	if e.value.Synthetic {
+		return
+	}
+
+	for newer := e.prev; newer != nil && newer.value.Synthetic; newer = newer.prev {
+		newer.value = s.painted(key, e.value, newer.value.Ts)
+	}
+}
+
+func (s *Store) painted(key string, previous *model.Candle, ts time.Time) *model.Candle {
+	painted := previous.Clone()
+	painted.Ts = ts
+	painted.Volume = 0
+	painted.Amount = 0
+	painted.Synthetic = true
+
+	// Log at most once per minute per key (thread-safe)
+	if lastVal, ok := s.logCache.Load(key); !ok || time.Since(lastVal.(time.Time)) > time.Minute {
+		logrus.Warnf("saving painted candle: ts '%s' for '%s'...", painted.Ts, key)
+		s.logCache.Store(key, time.Now())
+	}
+
+	return painted
+}
+
+// keepBudget evicts the least recently read buckets while the candles budget is exceeded, sparing the
+// bucket just stored into. It returns the evicted keys.
+func (s *Store) keepBudget(stored string) []string {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	defer metrics.CachedCandles.Set(float64(s.candles))
+
+	if s.maxCandles <= 0 || s.candles <= s.maxCandles {
+		return nil
+	}
+
+	keys := make([]string, 0, len(s.mappedLists))
+	for key := range s.mappedLists {
+		if key != stored {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return s.mappedLists[keys[i]].accessed.Load() < s.mappedLists[keys[j]].accessed.Load()
+	})
+
+	evicted := make([]string, 0, 1)
+	for _, key := range keys {
+		if s.candles <= s.maxCandles {
+			break
+		}
+
+		size := s.mappedLists[key].size()
+		s.drop(key)
+		evicted = append(evicted, key)
+
+		logrus.Warnf("evicted bucket for key '%s' with %d candles to keep the budget of %d candles", key, size, s.maxCandles)
+		metrics.EvictedBuckets.Inc()
+		metrics.EvictedCandles.Add(float64(size))
+	}
+
+	return evicted
+}
+
+// drop removes the bucket of the key, the write lock must be held.
+func (s *Store) drop(key string) {
+	s.candles -= s.mappedLists[key].size()
+	delete(s.mappedLists, key)
+
+	metrics.CachedBuckets.Set(float64(len(s.mappedLists)))
+	metrics.CachedCandles.Set(float64(s.candles))
 }
 
 func (s *Store) Get(key string, from time.Time, to time.Time) []*model.Candle {
 	s.l.RLock()
+	defer s.l.RUnlock()
+
 	bucket := s.mappedLists[key]
-	s.l.RUnlock()
 	if bucket == nil {
 		logrus.Debugf("Get: no bucket found for key '%s'", key)
 		return nil
 	}
 
-	// No need to lock for reading the bucket if selectFn is safe
+	bucket.accessed.Store(time.Now().UnixNano())
+
+	// the bucket is kept sorted newest first, which selectFn relies on
 	candles := bucket.selectFn(
 		func(candle *model.Candle) bool { return candle.Ts.Equal(from) || candle.Ts.Before(from) },
 		func(candle *model.Candle) bool { return candle.Ts.Equal(to) || candle.Ts.Before(to) },
@@ -119,3 +401,81 @@ func (s *Store) Get(key string, from time.Time, to time.Time) []*model.Candle {
 
 	return candles
 }
+
+// Updated returns the time a candle was last stored for the key, zero if there is no bucket.
+func (s *Store) Updated(key string) time.Time {
+	s.l.RLock()
+	defer s.l.RUnlock()
+
+	bucket := s.mappedLists[key]
+	if bucket == nil || bucket.updated.Load() == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, bucket.updated.Load()).UTC()
+}
+
+// BucketStats describes a bucket of candles, First and Last being its oldest and newest candle.
+type BucketStats struct {
+	Key     string    `json:"key"`
+	Size    int       `json:"size"`
+	First   time.Time `json:"first"`
+	Last    time.Time `json:"last"`
+	Painted int       `json:"painted"`
+	// Verified are the spans known to hold every candle there is
+	Verified []Span `json:"verified"`
+	// Extended are the spans verified by websocket updates alone
+	Extended []Span `json:"extended"`
+}
+
+func (s *Store) Buckets() []BucketStats {
+	s.l.RLock()
+	defer s.l.RUnlock()
+
+	stats := make([]BucketStats, 0, len(s.mappedLists))
+	for key, bucket := range s.mappedLists {
+		stat := BucketStats{Key: key, Size: bucket.size(), Verified: append([]Span{}, bucket.verified...), Extended: append([]Span{}, bucket.extended...)}
+		if bucket.first != nil {
+			stat.Last = bucket.first.value.Ts
+			stat.First = bucket.last.value.Ts
+		}
+		for element := bucket.first; element != nil; element = element.next {
+			if element.value.Synthetic {
+				stat.Painted++
+			}
+		}
+		stats = append(stats, stat)
+	}
+
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Key < stats[j].Key })
+
+	return stats
+}
+
+// Evict drops the bucket of the key, reporting whether it existed.
+func (s *Store) Evict(key string) bool {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	if _, ok := s.mappedLists[key]; !ok {
+		return false
+	}
+
+	s.drop(key)
+	logrus.Infof("evicted bucket for key '%s'", key)
+
+	return true
+}
+
+// Candles returns all candles of the key, newest first.
+func (s *Store) Candles(key string) []*model.Candle {
+	s.l.RLock()
+	defer s.l.RUnlock()
+
+	bucket := s.mappedLists[key]
+	if bucket == nil {
+		return nil
+	}
+
+	return bucket.values()
+}
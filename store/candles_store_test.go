@@ -0,0 +1,287 @@
+package store_test
+
+import (
+	"testing"
+	"testing/quick"
+	"time"
+
+	"github.com/stash86/kucoin-proxy/model"
+	"github.com/stash86/kucoin-proxy/store"
+)
+
+var testTs = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func candleAt(hours int) *model.Candle {
+	return &model.Candle{Ts: testTs.Add(time.Duration(hours) * time.Hour), Open: float64(hours), Close: float64(hours), Volume: 1}
+}
+
+func TestStorePaintsDistinctSyntheticCandles(t *testing.T) {
+	s := store.NewStore(100, store.GapPaint)
+	s.Store("key", time.Hour, candleAt(0), candleAt(3))
+
+	candles := s.Candles("key")
+	if len(candles) != 4 {
+		t.Fatalf("len = %d, want 4", len(candles))
+	}
+
+	painted1, painted2 := candles[1], candles[2]
+	if painted1 == painted2 {
+		t.Fatal("painted candles share the same object")
+	}
+	if !painted1.Synthetic || !painted2.Synthetic || candles[0].Synthetic || candles[3].Synthetic {
+		t.Errorf("synthetic flags = %v %v %v %v, want false true true false", candles[0].Synthetic, painted1.Synthetic, painted2.Synthetic, candles[3].Synthetic)
+	}
+	if !painted1.Ts.Equal(testTs.Add(2*time.Hour)) || !painted2.Ts.Equal(testTs.Add(time.Hour)) {
+		t.Errorf("painted ts = %s %s", painted1.Ts, painted2.Ts)
+	}
+	if painted1.Volume != 0 || painted1.Close != 0 {
+		t.Errorf("painted candle = %+v, want a copy of the previous candle without volume", painted1)
+	}
+}
+
+func TestStoreSkipsGaps(t *testing.T) {
+	s := store.NewStore(100, store.GapSkip)
+	s.Store("key", time.Hour, candleAt(0), candleAt(3))
+
+	if got := len(s.Candles("key")); got != 2 {
+		t.Errorf("len = %d, want 2", got)
+	}
+}
+
+func TestStoreBackfillsGaps(t *testing.T) {
+	s := store.NewStore(100, store.GapBackfill)
+
+	var gaps []store.Span
+	s.OnGap(func(key string, gap store.Span) { gaps = append(gaps, gap) })
+
+	s.Store("key", time.Hour, candleAt(0), candleAt(3))
+
+	if len(gaps) != 1 || !gaps[0].From.Equal(testTs.Add(time.Hour)) || !gaps[0].To.Equal(testTs.Add(3*time.Hour)) {
+		t.Fatalf("gaps = %v", gaps)
+	}
+
+	s.Store("key", time.Hour, candleAt(2))
+
+	candles := s.Candles("key")
+	if len(candles) != 4 || candles[1].Synthetic || candles[1].Volume != 1 || !candles[2].Synthetic {
+		t.Errorf("candles after fill = %+v %+v", candles[1], candles[2])
+	}
+	if len(gaps) != 1 {
+		t.Errorf("filling a painted candle reported gaps %v", gaps)
+	}
+}
+
+func TestStorePaintsOlderGaps(t *testing.T) {
+	s := store.NewStore(100, store.GapPaint)
+	s.Store("key", time.Hour, candleAt(5), candleAt(6))
+	s.Store("key", time.Hour, candleAt(1))
+
+	candles := s.Candles("key")
+	if len(candles) != 6 {
+		t.Fatalf("len = %d, want 6", len(candles))
+	}
+	for i, c := range candles {
+		if want := testTs.Add(time.Duration(6-i) * time.Hour); !c.Ts.Equal(want) {
+			t.Errorf("candles[%d].Ts = %s, want %s", i, c.Ts, want)
+		}
+		if synthetic := i >= 2 && i <= 4; c.Synthetic != synthetic {
+			t.Errorf("candles[%d].Synthetic = %v, want %v", i, c.Synthetic, synthetic)
+		}
+	}
+	if candles[2].Open != 1 {
+		t.Errorf("painted candle copies %v, want the older neighbour", candles[2].Open)
+	}
+}
+
+// TestStoreKeepsOrderProperty stores random batches of candles in random order and checks the bucket ends
+// up the same as if they came sorted: newest first, unique ts, and every real candle kept.
+func TestStoreKeepsOrderProperty(t *testing.T) {
+	const cacheSize = 30
+
+	property := func(hours []uint8, batch uint8, mode bool) bool {
+		gapMode := store.GapSkip
+		if mode {
+			gapMode = store.GapPaint
+		}
+
+		s := store.NewStore(cacheSize, gapMode)
+
+		stored := map[int]bool{}
+		candles := make([]*model.Candle, 0, len(hours))
+		for _, h := range hours {
+			hour := int(h % 64)
+			stored[hour] = true
+			candles = append(candles, candleAt(hour))
+		}
+
+		size := int(batch%5) + 1
+		for i := 0; i < len(candles); i += size {
+			s.Store("key", time.Hour, candles[i:min(i+size, len(candles))]...)
+		}
+
+		got := s.Candles("key")
+		if len(got) > cacheSize {
+			return false
+		}
+
+		kept := map[int]bool{}
+		for i, c := range got {
+			if i > 0 && !c.Ts.Before(got[i-1].Ts) {
+				return false
+			}
+			if gapMode == store.GapPaint && i > 0 && got[i-1].Ts.Sub(c.Ts) != time.Hour {
+				return false
+			}
+
+			hour := int(c.Ts.Sub(testTs) / time.Hour)
+			if c.Synthetic == stored[hour] {
+				return false
+			}
+			kept[hour] = true
+		}
+
+		if len(got) == 0 {
+			return len(stored) == 0
+		}
+
+		// every real candle within the window of the newest cache size hours is kept
+		oldest := int(got[len(got)-1].Ts.Sub(testTs) / time.Hour)
+		for hour := range stored {
+			if hour >= oldest && !kept[hour] {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	if err := quick.Check(property, &quick.Config{MaxCount: 500}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStoreEvictsLeastRecentlyReadBuckets(t *testing.T) {
+	s := store.NewStore(10, store.GapSkip)
+	s.LimitCandles(5)
+
+	var evicted []string
+	s.OnEvict(func(key string) { evicted = append(evicted, key) })
+
+	s.Store("a", time.Hour, candleAt(0), candleAt(1))
+	s.Store("b", time.Hour, candleAt(0), candleAt(1))
+	s.Get("a", testTs, testTs.Add(time.Hour))
+
+	s.Store("c", time.Hour, candleAt(0), candleAt(1))
+
+	if len(evicted) != 1 || evicted[0] != "b" {
+		t.Fatalf("evicted = %v, want [b]", evicted)
+	}
+	if s.Candles("b") != nil || len(s.Candles("a")) != 2 || len(s.Candles("c")) != 2 {
+		t.Errorf("buckets after eviction: a=%d b=%d c=%d", len(s.Candles("a")), len(s.Candles("b")), len(s.Candles("c")))
+	}
+}
+
+func TestStoreKeepsCountWhileEvicting(t *testing.T) {
+	s := store.NewStore(100, store.GapSkip)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			s.Evict("a")
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		s.Store("a", time.Hour, candleAt(0), candleAt(1), candleAt(2))
+	}
+	<-done
+	s.Evict("a")
+
+	// candles stored into an evicted bucket would still count against the budget
+	evicted := 0
+	s.OnEvict(func(string) { evicted++ })
+	s.LimitCandles(3)
+	s.Store("b", time.Hour, candleAt(0), candleAt(1))
+	s.Store("c", time.Hour, candleAt(0))
+
+	if evicted != 0 {
+		t.Errorf("evicted %d buckets within the budget", evicted)
+	}
+}
+
+func TestStoreVerifiesSpans(t *testing.T) {
+	at := func(hours int) time.Time { return testTs.Add(time.Duration(hours) * time.Hour) }
+	span := func(from int, to int) store.Span { return store.Span{From: at(from), To: at(to)} }
+	check := func(s *store.Store, want ...store.Span) {
+		t.Helper()
+		got := s.Missing("key", span(0, 10))
+		if len(got) != len(want) {
+			t.Fatalf("missing = %v, want %v", got, want)
+		}
+		for i := range got {
+			if !got[i].From.Equal(want[i].From) || !got[i].To.Equal(want[i].To) {
+				t.Fatalf("missing = %v, want %v", got, want)
+			}
+		}
+	}
+
+	s := store.NewStore(5, store.GapSkip)
+
+	// nothing is verified without a bucket
+	s.Verify("key", span(0, 4))
+	check(s, span(0, 10))
+
+	s.Store("key", time.Hour, candleAt(0), candleAt(1), candleAt(2))
+	s.Verify("key", span(0, 3))
+	check(s, span(3, 10))
+
+	// stored candles verify nothing, even at the end of a verified span
+	s.Store("key", time.Hour, candleAt(3), candleAt(6))
+	check(s, span(3, 10))
+
+	s.Verify("key", span(4, 7))
+	check(s, span(3, 4), span(7, 10))
+
+	// a full bucket drops what it verified before its oldest candle
+	s.Store("key", time.Hour, candleAt(7))
+	check(s, span(0, 1), span(3, 4), span(7, 10))
+}
+
+func TestStoreExtendsVerifiedSpans(t *testing.T) {
+	at := func(hours int) time.Time { return testTs.Add(time.Duration(hours) * time.Hour) }
+	span := func(from int, to int) store.Span { return store.Span{From: at(from), To: at(to)} }
+	check := func(s *store.Store, want ...store.Span) {
+		t.Helper()
+		got := s.Missing("key", span(0, 10))
+		if len(got) != len(want) {
+			t.Fatalf("missing = %v, want %v", got, want)
+		}
+		for i := range got {
+			if !got[i].From.Equal(want[i].From) || !got[i].To.Equal(want[i].To) {
+				t.Fatalf("missing = %v, want %v", got, want)
+			}
+		}
+	}
+
+	s := store.NewStore(100, store.GapSkip)
+	s.Store("key", time.Hour, candleAt(0), candleAt(1), candleAt(2))
+	s.Verify("key", span(0, 3))
+
+	// updates continuing the verified span extend it, one at a time
+	s.Extend("key", time.Hour, at(3))
+	check(s, span(4, 10))
+	s.Extend("key", time.Hour, at(4))
+	check(s, span(5, 10))
+
+	// an update skipping a period drops every extension, the verified span is kept
+	s.Extend("key", time.Hour, at(6))
+	check(s, span(3, 10))
+
+	s.Extend("key", time.Hour, at(3))
+	s.DropExtended("key")
+	check(s, span(3, 10))
+
+	if stats := s.Buckets(); len(stats[0].Extended) != 0 || len(stats[0].Verified) != 1 {
+		t.Errorf("stats = %+v, want a single verified span", stats[0])
+	}
+}
@@ -0,0 +1,59 @@
+package store
+
+import (
+	"sort"
+	"time"
+)
+
+// Span is a half-open time range [From, To).
+type Span struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+// cover merges the span into the sorted list of spans, joining the ones it overlaps or touches.
+func cover(spans []Span, span Span) []Span {
+	merged := make([]Span, 0, len(spans)+1)
+
+	for _, s := range spans {
+		if s.To.Before(span.From) || span.To.Before(s.From) {
+			merged = append(merged, s)
+			continue
+		}
+		if s.From.Before(span.From) {
+			span.From = s.From
+		}
+		if s.To.After(span.To) {
+			span.To = s.To
+		}
+	}
+
+	merged = append(merged, span)
+	sort.Slice(merged, func(i, j int) bool { return merged[i].From.Before(merged[j].From) })
+
+	return merged
+}
+
+// missing returns the parts of span the sorted list of spans does not cover.
+func missing(spans []Span, span Span) []Span {
+	gaps := make([]Span, 0, 1)
+	from := span.From
+	for _, s := range spans {
+		if !s.To.After(from) {
+			continue
+		}
+		if !s.From.Before(span.To) {
+			break
+		}
+		if s.From.After(from) {
+			gaps = append(gaps, Span{From: from, To: s.From})
+		}
+		from = s.To
+	}
+
+	if from.Before(span.To) {
+		gaps = append(gaps, Span{From: from, To: span.To})
+	}
+
+	return gaps
+}
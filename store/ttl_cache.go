@@ -1,6 +1,8 @@
 package store
 
 import (
+	"container/list"
+	"sort"
 	"sync"
 	"time"
 
@@ -8,27 +10,83 @@ import (
 )
 
 type Container struct {
+	key       string
 	raw       []byte
 	expiresAt time.Time
+	storedAt  time.Time
+	element   *list.Element
+	cache     *TTLCache
+	// size is the size of the blob and its variants, guarded by the cache lock
+	size int
+
+	variantsLock sync.Mutex
+	variants     map[string][]byte
 }
 
 func (c *Container) Raw() []byte {
 	return c.raw
 }
 
+func (c *Container) StoredAt() time.Time {
+	return c.storedAt
+}
+
+// Variant returns the blob transformed by fn, e.g. compressed, computing it once per name. Variants count
+// toward the bytes limit of the cache along with the blob.
+func (c *Container) Variant(name string, fn func(raw []byte) []byte) []byte {
+	c.variantsLock.Lock()
+	defer c.variantsLock.Unlock()
+
+	if variant, ok := c.variants[name]; ok {
+		return variant
+	}
+
+	if c.variants == nil {
+		c.variants = map[string][]byte{}
+	}
+	variant := fn(c.raw)
+	c.variants[name] = variant
+
+	if c.cache != nil {
+		c.cache.grow(c, len(variant))
+	}
+
+	return variant
+}
+
 func NewTTLCache(expirationTimeout time.Duration) *TTLCache {
 	return &TTLCache{
 		l:                 new(sync.Mutex),
 		kv:                map[string]*Container{},
+		lru:               list.New(),
 		expirationTimeout: expirationTimeout,
 	}
 }
 
+// TTLCache holds blobs until they expire, the least recently read ones are evicted beyond its limits.
 type TTLCache struct {
 	l *sync.Mutex
 
 	kv                map[string]*Container
+	lru               *list.List // of keys, most recently used first
 	expirationTimeout time.Duration
+
+	maxEntries int
+	maxBytes   int
+	bytes      int
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Limit bounds the amount of entries and the total size of their blobs, 0 meaning unlimited.
+func (s *TTLCache) Limit(maxEntries int, maxBytes int) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	s.maxEntries = maxEntries
+	s.maxBytes = maxBytes
+	s.evict()
 }
 
 func (s *TTLCache) Get(key string) *Container {
@@ -43,21 +101,161 @@ func (s *TTLCache) Get(key string) *Container {
 
 	if container.expiresAt.Before(time.Now().UTC()) {
 		logrus.Debugf("TTLCache.Get: expired entry for key '%s' (expired at %s)", key, container.expiresAt)
-		delete(s.kv, key)
+		s.remove(container)
 		return nil
 	}
 
+	s.lru.MoveToFront(container.element)
+
 	return container
 }
 
 func (s *TTLCache) Store(key string, value []byte) {
+	s.StoreFor(key, value, s.expirationTimeout)
+}
+
+// StoreFor stores the blob with its own ttl instead of the cache wide one.
+func (s *TTLCache) StoreFor(key string, value []byte, ttl time.Duration) {
 	s.l.Lock()
 	defer s.l.Unlock()
 
-	expiresAt := time.Now().UTC().Add(s.expirationTimeout)
-	s.kv[key] = &Container{
+	if container, ok := s.kv[key]; ok {
+		s.remove(container)
+	}
+
+	now := time.Now().UTC()
+	expiresAt := now.Add(ttl)
+	container := &Container{
+		key:       key,
 		raw:       value,
 		expiresAt: expiresAt,
+		storedAt:  now,
+		cache:     s,
+		size:      len(value),
 	}
+	container.element = s.lru.PushFront(container)
+	s.kv[key] = container
+	s.bytes += container.size
+
 	logrus.Debugf("TTLCache.Store: stored key '%s' (expires at %s)", key, expiresAt)
+
+	s.evict()
+}
+
+// evict drops the least recently read entries while the limits are exceeded, the lock must be held.
+func (s *TTLCache) evict() {
+	for s.lru.Len() > 0 && (s.maxEntries > 0 && s.lru.Len() > s.maxEntries || s.maxBytes > 0 && s.bytes > s.maxBytes) {
+		container := s.lru.Back().Value.(*Container)
+		s.remove(container)
+		logrus.Debugf("TTLCache: evicted least recently used key '%s'", container.key)
+	}
+}
+
+// grow accounts a variant of the container while it is cached, evicting beyond the limits.
+func (s *TTLCache) grow(container *Container, size int) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	if s.kv[container.key] != container {
+		return
+	}
+
+	container.size += size
+	s.bytes += size
+	s.evict()
+}
+
+func (s *TTLCache) remove(container *Container) {
+	s.lru.Remove(container.element)
+	delete(s.kv, container.key)
+	s.bytes -= container.size
+}
+
+// RunJanitor sweeps expired entries every interval until Close.
+func (s *TTLCache) RunJanitor(interval time.Duration) {
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+
+	go func() {
+		defer close(s.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				if swept := s.Sweep(); swept > 0 {
+					logrus.Debugf("TTLCache: swept %d expired entries", swept)
+				}
+			}
+		}
+	}()
+}
+
+// Sweep removes the expired entries, returning their amount.
+func (s *TTLCache) Sweep() int {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	now := time.Now().UTC()
+	swept := 0
+	for _, container := range s.kv {
+		if container.expiresAt.Before(now) {
+			s.remove(container)
+			swept++
+		}
+	}
+
+	return swept
+}
+
+// Close stops the janitor and waits for it to exit.
+func (s *TTLCache) Close() {
+	if s.stop == nil {
+		return
+	}
+
+	close(s.stop)
+	<-s.done
+	s.stop = nil
+}
+
+// Entry describes a cached blob, Size counting its variants.
+type Entry struct {
+	Key       string    `json:"key"`
+	Size      int       `json:"size"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+func (s *TTLCache) Entries() []Entry {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	entries := make([]Entry, 0, len(s.kv))
+	for key, container := range s.kv {
+		entries = append(entries, Entry{Key: key, Size: container.size, ExpiresAt: container.expiresAt})
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+
+	return entries
+}
+
+// Evict drops the blob of the key, reporting whether it existed.
+func (s *TTLCache) Evict(key string) bool {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	container, ok := s.kv[key]
+	if !ok {
+		return false
+	}
+
+	s.remove(container)
+	logrus.Infof("TTLCache.Evict: evicted key '%s'", key)
+
+	return true
 }
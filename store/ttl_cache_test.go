@@ -0,0 +1,76 @@
+package store_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stash86/kucoin-proxy/store"
+)
+
+func TestTTLCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := store.NewTTLCache(time.Minute)
+	cache.Limit(2, 0)
+
+	cache.Store("a", []byte("1"))
+	cache.Store("b", []byte("2"))
+	cache.Get("a")
+	cache.Store("c", []byte("3"))
+
+	if cache.Get("b") != nil {
+		t.Error("least recently used entry was kept")
+	}
+	if cache.Get("a") == nil || cache.Get("c") == nil {
+		t.Error("recently used entries were evicted")
+	}
+
+	cache.Limit(0, 4)
+	cache.Store("d", []byte("4444"))
+
+	if entries := cache.Entries(); len(entries) != 1 || entries[0].Key != "d" {
+		t.Errorf("entries over the bytes limit = %+v", entries)
+	}
+}
+
+func TestTTLCacheSweepsExpiredEntries(t *testing.T) {
+	cache := store.NewTTLCache(time.Minute)
+
+	cache.StoreFor("expired", []byte("1"), -time.Second)
+	cache.Store("fresh", []byte("2"))
+
+	if swept := cache.Sweep(); swept != 1 {
+		t.Errorf("swept = %d, want 1", swept)
+	}
+	if entries := cache.Entries(); len(entries) != 1 || entries[0].Key != "fresh" {
+		t.Errorf("entries after sweep = %+v", entries)
+	}
+
+	cache.RunJanitor(time.Millisecond)
+	cache.Close()
+}
+
+func TestTTLCacheCountsVariants(t *testing.T) {
+	cache := store.NewTTLCache(time.Minute)
+	cache.Limit(0, 13)
+
+	cache.Store("a", []byte("1111"))
+	cache.Store("b", []byte("2222"))
+
+	a := cache.Get("a")
+	a.Variant("double", func(raw []byte) []byte { return append(raw, raw...) })
+	a.Variant("double", func(raw []byte) []byte { t.Error("variant computed twice"); return nil })
+
+	if cache.Get("b") != nil {
+		t.Error("variant exceeding the bytes limit did not evict")
+	}
+	if entries := cache.Entries(); len(entries) != 1 || entries[0].Size != 12 {
+		t.Errorf("entries = %+v, want a of 12 bytes", entries)
+	}
+
+	// the variant is released along with its blob
+	cache.Limit(0, 16)
+	cache.Store("a", []byte("1111"))
+	cache.Store("c", []byte("3333333333"))
+	if cache.Get("a") == nil || cache.Get("c") == nil {
+		t.Errorf("entries within the bytes limit were evicted: %+v", cache.Entries())
+	}
+}
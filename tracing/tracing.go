@@ -0,0 +1,132 @@
+// Package tracing holds the OpenTelemetry tracing of the proxy.
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/valyala/fasthttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	instrumentationName = "github.com/stash86/kucoin-proxy"
+	serviceName         = "kucoin-proxy"
+
+	// spanUserValue holds the server span of a fasthttp request, which is not a context of its own.
+	spanUserValue = "span"
+)
+
+// Setup exports the spans to the OTLP/HTTP endpoint, sampling ratio of the traces not started by a sampled
+// client. The returned func flushes the pending spans on shutdown.
+func Setup(endpoint string, ratio float64, version string) (func(context.Context) error, error) {
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, fmt.Errorf("otlp exporter: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewSchemaless(
+			semconv.ServiceName(serviceName),
+			semconv.ServiceVersion(version),
+		)),
+	)
+
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	return provider.Shutdown, nil
+}
+
+// Start starts a span in ctx, a fasthttp request being the child of its server span.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		if span, ok := ctx.Value(spanUserValue).(trace.Span); ok {
+			ctx = trace.ContextWithSpan(ctx, span)
+		}
+	}
+
+	return otel.Tracer(instrumentationName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// TraceID returns the id of the sampled trace of ctx, empty if it isn't traced.
+func TraceID(ctx context.Context) string {
+	spanContext := trace.SpanContextFromContext(ctx)
+	if span, ok := ctx.Value(spanUserValue).(trace.Span); ok && !spanContext.IsValid() {
+		spanContext = span.SpanContext()
+	}
+
+	if !spanContext.IsSampled() {
+		return ""
+	}
+
+	return spanContext.TraceID().String()
+}
+
+// End ends the span, marking it failed with err.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+// Handler traces every request in a server span, continuing the trace of a client sending traceparent.
+func Handler(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		parent := otel.GetTextMapPropagator().Extract(context.Background(), requestHeaderCarrier{&ctx.Request.Header})
+
+		_, span := otel.Tracer(instrumentationName).Start(parent, string(ctx.Method())+" "+string(ctx.Path()),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(string(ctx.Method())),
+				semconv.URLPath(string(ctx.Path())),
+			),
+		)
+		defer span.End()
+
+		ctx.SetUserValue(spanUserValue, span)
+
+		h(ctx)
+
+		status := ctx.Response.StatusCode()
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if status >= fasthttp.StatusInternalServerError {
+			span.SetStatus(codes.Error, fasthttp.StatusMessage(status))
+		}
+	}
+}
+
+// requestHeaderCarrier reads the propagated trace of a request.
+type requestHeaderCarrier struct {
+	header *fasthttp.RequestHeader
+}
+
+func (c requestHeaderCarrier) Get(key string) string {
+	return string(c.header.Peek(key))
+}
+
+func (c requestHeaderCarrier) Set(key string, value string) {
+	c.header.Set(key, value)
+}
+
+func (c requestHeaderCarrier) Keys() []string {
+	keys := make([]string, 0, c.header.Len())
+	c.header.VisitAll(func(key, _ []byte) {
+		keys = append(keys, string(key))
+	})
+
+	return keys
+}
@@ -0,0 +1,55 @@
+package tracing_test
+
+import (
+	"testing"
+
+	"github.com/stash86/kucoin-proxy/tracing"
+	"github.com/valyala/fasthttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestHandler(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	var traceID string
+	handler := tracing.Handler(func(ctx *fasthttp.RequestCtx) {
+		_, span := tracing.Start(ctx, "child")
+		span.End()
+
+		traceID = tracing.TraceID(ctx)
+		ctx.SetStatusCode(fasthttp.StatusBadGateway)
+	})
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.SetRequestURI("/kucoin/api/v1/market/candles")
+	ctx.Request.Header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	handler(ctx)
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("exported %d spans, want 2", len(spans))
+	}
+
+	child, server := spans[0], spans[1]
+	if server.Name != "GET /kucoin/api/v1/market/candles" || server.SpanKind != trace.SpanKindServer {
+		t.Errorf("server span = %s of kind %s", server.Name, server.SpanKind)
+	}
+	if got := server.Parent.SpanID().String(); got != "b7ad6b7169203331" {
+		t.Errorf("server span parent = %s, want the client span", got)
+	}
+	if child.Parent.SpanID() != server.SpanContext.SpanID() {
+		t.Error("child span is not a child of the server span")
+	}
+	if traceID != "0af7651916cd43dd8448eb211c80319c" {
+		t.Errorf("TraceID() = %q, want the client trace", traceID)
+	}
+	if server.Status.Code.String() != "Error" {
+		t.Errorf("server span status = %s, want Error for 502", server.Status.Code)
+	}
+}